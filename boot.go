@@ -1,240 +1,996 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/deis/workflow-migration/pkg"
-	"github.com/ghodss/yaml"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.5/kubernetes"
-	"k8s.io/client-go/1.5/pkg/api"
-	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
-	"k8s.io/client-go/1.5/pkg/fields"
-	"k8s.io/client-go/1.5/pkg/labels"
 	"k8s.io/client-go/1.5/rest"
-	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/client-go/1.5/tools/clientcmd"
 	rspb "k8s.io/helm/pkg/proto/hapi/release"
-	"k8s.io/helm/pkg/timeconv"
 )
 
-const apiVersion = "v1"
+const (
+	// Supported values for --target.
+	targetHelm2 = pkg.TargetHelm2
+	targetHelm3 = pkg.TargetHelm3
+
+	// Supported values for --on-existing.
+	existingRefuse    = "refuse"
+	existingSupersede = "supersede"
+)
+
+// The flags default to the environment variables set by the workflow-migration chart.
+var (
+	tillerFlag          = newTillerFlags(flag.CommandLine)
+	releaseNameFlag     = flag.String("release-name", getenv("RELEASE_NAME", "deis-workflow"), "name of the release to create")
+	workflowVersionFlag = flag.String("workflow-version", getenv("WORKFLOW_VERSION", "v2.7.0"), "version of the installed workflow")
+	targetFlag          = flag.String("target", getenv("MIGRATION_TARGET", targetHelm2), "release format to write: helm2 or helm3")
+	onExistingFlag      = flag.String("on-existing", getenv("ON_EXISTING_RELEASE", existingRefuse), "what to do if the release already has revisions: refuse or supersede")
+	paramsFlag          = flag.String("params", getenv("GENERATE_PARAMS", ""), "path to the generate_params.toml of the helm-classic install, to take the values from")
+	chartFlag           = flag.String("chart", getenv("TARGET_CHART", ""), "path to the target workflow chart, a directory or .tgz, to derive the hook secrets from")
+	manifestsFlag       = flag.String("manifests", getenv("HELMC_MANIFESTS", ""), "path to the manifests/ directory of the helm-classic workspace, to build the release manifest from instead of the live objects")
+	probeHostsFlag      = flag.String("probe-hosts", getenv("PROBE_HOSTS", ""), "comma separated app hostnames to probe through the router during the migration")
+	probeRouterFlag     = flag.String("probe-router", getenv("PROBE_ROUTER", "deis-router.deis"), "router address the probe sends requests to")
+	probeIntervalFlag   = flag.Duration("probe-interval", getenvDuration("PROBE_INTERVAL", time.Second), "time between probe requests")
+	probeTimeoutFlag    = flag.Duration("probe-timeout", getenvDuration("PROBE_TIMEOUT", 5*time.Second), "how long a probe request may take before it counts as a failure")
+	probeDowntimeFlag   = flag.Duration("probe-max-downtime", getenvDuration("PROBE_MAX_DOWNTIME", 10*time.Second), "longest app outage tolerated before the migration aborts")
+	probeAfterFlag      = flag.Duration("probe-after", getenvDuration("PROBE_AFTER", 0), "keep probing this long after the release is written, e.g. to cover `helm upgrade`")
+	healthTimeoutFlag   = flag.Duration("health-timeout", getenvDuration("HEALTH_TIMEOUT", 5*time.Minute), "how long to wait for workflow to become healthy before refusing to migrate, 0 skips the check")
+	lockDurationFlag    = flag.Duration("lock-duration", getenvDuration("LOCK_DURATION", 2*time.Minute), "how long the migration lock is valid without being renewed")
+	forceUnlockFlag     = flag.Bool("force-unlock", getenv("FORCE_UNLOCK", "") == "true", "remove a stale migration lock before taking it")
+	backupTimeoutFlag   = flag.Duration("backup-timeout", getenvDuration("BACKUP_TIMEOUT", 10*time.Minute), "how long to wait for a fresh base backup of the on-cluster database, 0 skips the backup")
+	backupCommandFlag   = flag.String("backup-command", getenv("BACKUP_COMMAND", "gosu postgres do_backup"), "command run in the deis-database pod to push a base backup")
+	tillerHostFlag      = flag.String("tiller-host", getenv("HELM_HOST", getenv("TILLER_HOST", "")), "address of tiller's gRPC endpoint, the tiller-deploy service or a port forwarded to it (the tiller-deploy service in --tiller-namespace if empty)")
+	tlsFlag             = flag.Bool("tls", getenv("HELM_TLS_ENABLE", "") == "true", "connect to tiller over TLS with the client certificate in --home")
+	tlsVerifyFlag       = flag.Bool("tls-verify", getenv("HELM_TLS_VERIFY", "") == "true", "connect to tiller over TLS and verify its certificate against the CA in --home")
+	helmHomeFlag        = flag.String("home", getenv("HELM_HOME", filepath.Join(getenv("HOME", ""), ".helm")), "helm home directory, holding the TLS certificates for tiller")
+	checkTillerFlag     = flag.Bool("check-tiller", getenv("CHECK_TILLER", "") == "true", "confirm through tiller's API that it reads the migrated release")
+	upgradeChartFlag    = flag.String("upgrade-chart", getenv("UPGRADE_CHART", ""), "path to a workflow chart, a directory or .tgz, to upgrade the migrated release to through tiller")
+	upgradeTimeoutFlag  = flag.Duration("upgrade-timeout", getenvDuration("UPGRADE_TIMEOUT", 5*time.Minute), "how long the migration waits for the upgrade and for workflow to become healthy after it")
+	watchdogFlag        = flag.Duration("watchdog", getenvDuration("WATCHDOG_DEADLINE", 0), "keep running this long after the migration, and restore the deleted deployments if the release isn't upgraded by then, 0 disables the watchdog")
+	keepStatefulFlag    = flag.Bool("keep-stateful", getenv("KEEP_STATEFUL_RESOURCES", "") == "true", "mark stateful objects with helm.sh/resource-policy: keep")
+	yesFlag             = flag.Bool("yes", getenv("CONFIRM_SECRET_CHANGES", "") == "true", "apply the planned secret changes without asking")
+	skipPermissionsFlag = flag.Bool("skip-permission-check", getenv("SKIP_PERMISSION_CHECK", "") == "true", "migrate without checking the permissions first, for servers that can't answer SelfSubjectAccessReviews")
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			inspect(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		case "fetch":
+			fetch(os.Args[2:])
+			return
+		case "conflicts":
+			conflicts(os.Args[2:])
+			return
+		}
+	}
+	flag.Parse()
 
-	// creates the in-cluster config
-	k8sConfig, err := rest.InClusterConfig()
+	k8sConfig, err := newConfig(*tillerFlag.kubeconfig, *tillerFlag.kubeContext)
 	if err != nil {
-		log.Fatalf("Failed to get config: %v", err)
+		fatalf("%v", err)
 	}
-	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(k8sConfig)
 	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+		fatalf("Failed to create client: %v", err)
 	}
 
-	raw, err := pkg.GetValues(clientset)
+	target := *targetFlag
+	if target != targetHelm2 && target != targetHelm3 {
+		fatalf("Unknown migration target %q, must be %q or %q", target, targetHelm2, targetHelm3)
+	}
+	releaseName := *releaseNameFlag
+	tillerNamespace := *tillerFlag.namespace
+
+	// Deployments and DaemonSets moved from extensions/v1beta1 to apps/v1 over the
+	// Kubernetes releases, so they are read and written in whatever group the
+	// server offers.
+	deploymentResource, err := pkg.ResolveResource(clientset, "Deployment")
+	if err != nil {
+		fatalf("Failed to discover the deployments API: %v", err)
+	}
+	daemonSetResource, err := pkg.ResolveResource(clientset, "DaemonSet")
 	if err != nil {
-		log.Fatalf("Failed to get values: %v", err)
+		fatalf("Failed to discover the daemonsets API: %v", err)
 	}
-	fmt.Println(raw)
+	log.Printf("server serves deployments as %s and daemonsets as %s", deploymentResource.APIVersion(), daemonSetResource.APIVersion())
 
-	secrets := []string{"builder-key-auth", "builder-ssh-private-keys", "database-creds", "django-secret-key", "logger-redis-creds"}
+	storage := *tillerFlag.storage
+	if target == targetHelm2 && storage == "" {
+		storage, err = pkg.DetectTillerStorage(clientset, tillerNamespace)
+		if err != nil {
+			fatalf("Failed to detect tiller storage driver, set it with --tiller-storage: %v", err)
+		}
+		log.Printf("detected tiller storage driver %q", storage)
+	}
+	if target == targetHelm2 && storage != pkg.StorageConfigMap && storage != pkg.StorageSecret {
+		fatalf("Unknown tiller storage driver %q, must be %q or %q", storage, pkg.StorageConfigMap, pkg.StorageSecret)
+	}
+	useTiller := *checkTillerFlag || *upgradeChartFlag != ""
+	if useTiller && target != targetHelm2 {
+		fatalf("--check-tiller and --upgrade-chart need the %q target", targetHelm2)
+	}
+	onExisting := *onExistingFlag
+	if onExisting != existingRefuse && onExisting != existingSupersede {
+		fatalf("Unknown --on-existing value %q, must be %q or %q", onExisting, existingRefuse, existingSupersede)
+	}
 
-	// Adding the annotation as pre-install hooks will make sure that they don't change
-	// during the upgrade from helm classic to helm.
-	pkg.UpdateSecrets(clientset, secrets)
+	// The options of the migration are filled in as the run goes; every step works
+	// in their namespace.
+	opts := pkg.Options{
+		Namespace:       "deis",
+		TillerNamespace: tillerNamespace,
+		ReleaseName:     releaseName,
+		Version:         *workflowVersionFlag,
+		Target:          target,
+		Storage:         storage,
+		Supersede:       onExisting == existingSupersede,
+		HookSecrets:     pkg.DefaultHookSecrets,
+	}
 
-	// Deployments needs to be deleted because of the issue in kubernetes patching for releases before 1.4.4
-	// https://github.com/kubernetes/kubernetes/pull/35071.
-	err = deleteDeployments(clientset)
-	if err != nil && !apierrors.IsNotFound(err) {
-		log.Fatalf("failed to delete the deployment: %v", err)
+	var manifestFiles []pkg.ManifestFile
+	if *manifestsFlag != "" {
+		manifestFiles, err = pkg.ReadManifestDir(*manifestsFlag)
+		if err != nil {
+			fatalf("Failed to read manifests %s: %v", *manifestsFlag, err)
+		}
 	}
 
-	ts := timeconv.Now()
-	workflowVersion := getenv("WORKFLOW_VERSION", "v2.7.0")
-	config := &chart.Config{Raw: raw}
-	chartmetadata := &chart.Metadata{Name: "workflow", Version: workflowVersion}
+	// On RBAC enabled clusters a missing permission would otherwise only show up
+	// halfway through, after the secrets have been annotated. A check that can't be
+	// answered proves nothing, so it stops the migration too.
+	if *skipPermissionsFlag {
+		log.Println("skipping the permission check")
+	} else {
+		perms := requiredPermissions(opts.Namespace, target, storage, tillerNamespace, *tillerFlag.storage == "" || useTiller, *keepStatefulFlag, *backupTimeoutFlag > 0, *watchdogFlag > 0, deploymentResource.Group, daemonSetResource.Group)
+		lookups, err := pkg.LookupPermissions(clientset, pkg.ManifestRefs(pkg.ManifestFromFiles(manifestFiles, opts.Namespace, nil, nil, nil), opts.Namespace))
+		if err != nil {
+			fatalf("Failed to list the permissions the manifests check needs: %v", err)
+		}
+		perms = append(perms, lookups...)
+		missing, err := pkg.MissingPermissions(clientset, perms)
+		if err != nil {
+			fatalf("Refusing to migrate: the permission check failed, rerun with --skip-permission-check to migrate without it: %v", err)
+		}
+		if len(missing) > 0 {
+			for _, perm := range missing {
+				log.Printf("missing permission: %s", perm)
+			}
+			roles, err := pkg.Roles(clientset, missing, "workflow-migration")
+			if err != nil {
+				fatalf("Failed to render roles: %v", err)
+			}
+			fmt.Println("# Apply these roles and bind them to the service account the migration runs as, e.g.")
+			fmt.Println("# kubectl --namespace=<namespace> create rolebinding workflow-migration --role=workflow-migration --serviceaccount=<namespace>:<service account>")
+			fmt.Print(roles)
+			fatalf("Refusing to migrate: %d permission(s) missing", len(missing))
+		}
+	}
 
-	// Get the manifest based on the current workflow install which are identfied
-	// by the label `heritage: deis`.
-	manifestDoc, err := getManifest(clientset, secrets)
+	// Only one migration may run against a cluster at a time. The lock is taken
+	// before the release is inspected so that decisions aren't based on state
+	// another run is about to change.
+	if *forceUnlockFlag {
+		if err := pkg.ForceUnlock(clientset, opts.Namespace); err != nil {
+			fatalf("Failed to remove migration lock: %v", err)
+		}
+		log.Println("removed migration lock")
+	}
+	migrationLock, err = pkg.AcquireLock(clientset, opts.Namespace, lockHolder(), *lockDurationFlag)
 	if err != nil {
-		log.Fatal("get manifest error", err)
+		fatalf("Failed to take migration lock: %v", err)
 	}
-	log.Println("generated manifest")
-	log.Println(manifestDoc.String())
+	// Another run may take the lock over once the lease is lost, so the migration
+	// stops after the step in progress rather than racing it.
+	ctx, stopMigration := context.WithCancel(context.Background())
+	defer stopMigration()
+	migrationLock.KeepRenewed(func(err error) {
+		log.Printf("Lost migration lock, stopping after the current step: %v", err)
+		stopMigration()
+	})
+	defer releaseLock()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fatalf("Interrupted by %s", sig)
+	}()
 
-	releaseName := getenv("RELEASE_NAME", "deis-workflow")
-	actualrel := &rspb.Release{
-		Name:      releaseName,
-		Namespace: "deis",
-		Version:   1,
-		Config:    config,
-		Chart:     &chart.Chart{Metadata: chartmetadata, Values: config},
-		Info: &rspb.Info{
-			FirstDeployed: ts,
-			LastDeployed:  ts,
-			Status:        &rspb.Status{Code: rspb.Status_DEPLOYED},
+	// The secrets generated by the target chart are kept as they are, since
+	// rendering them again would replace keys and passwords with new random values.
+	// The manifest records the apiVersion the target chart uses for each kind, so
+	// that the upgrade compares objects in the version it renders them in.
+	var details []string
+	secretsSource := "default list"
+	if *chartFlag != "" {
+		templates, err := pkg.ChartTemplates(*chartFlag)
+		if err != nil {
+			fatalf("Failed to read chart %s: %v", *chartFlag, err)
+		}
+		opts.HookSecrets = pkg.HookSecrets(templates)
+		secretsSource = *chartFlag
+		var versionConflicts []string
+		opts.APIVersions, versionConflicts = pkg.ChartAPIVersions(templates)
+		opts.TemplatePaths = pkg.TemplatePaths(templates)
+		for _, conflict := range versionConflicts {
+			details = append(details, fmt.Sprintf("apiVersion conflict in %s: %s", *chartFlag, conflict))
+		}
+	}
+	details = append(details, fmt.Sprintf("hook secrets (from %s): %s", secretsSource, strings.Join(opts.HookSecrets, ", ")))
+	for _, r := range []pkg.APIResource{deploymentResource, daemonSetResource} {
+		version := r.APIVersion()
+		if chartVersion, ok := opts.APIVersions[r.Kind]; ok {
+			version = chartVersion
+		}
+		details = append(details, fmt.Sprintf("manifest apiVersion of %s: %s", r.Kind, version))
+	}
+
+	// Objects that hold state are kept by `helm delete` so that removing the release
+	// doesn't take the database, object storage credentials or keys with it.
+	if *keepStatefulFlag {
+		opts.Protected, err = pkg.StatefulObjects(clientset, opts.Namespace)
+		if err != nil {
+			fatalf("Failed to list stateful objects: %v", err)
+		}
+		for _, obj := range opts.Protected {
+			details = append(details, fmt.Sprintf("protect: %s", obj))
+		}
+	}
+
+	// The manifests helm-classic applied are checked against the cluster now, since
+	// the migration itself deletes some of the objects they describe.
+	if *manifestsFlag != "" {
+		opts.ManifestFiles = manifestFiles
+		refs := pkg.ManifestRefs(pkg.ManifestFromFiles(opts.ManifestFiles, opts.Namespace, opts.HookSecrets, nil, nil), opts.Namespace)
+		missing, unchecked, err := pkg.MissingObjects(clientset, refs)
+		if err != nil {
+			fatalf("Failed to look up the objects of %s: %v", *manifestsFlag, err)
+		}
+		for _, obj := range unchecked {
+			details = append(details, fmt.Sprintf("not checked: %s", obj))
+		}
+		if len(missing) > 0 {
+			for _, obj := range missing {
+				log.Printf("missing from the cluster: %s", obj)
+			}
+			fatalf("Refusing to migrate: %d object(s) in %s don't exist in the cluster", len(missing), *manifestsFlag)
+		}
+		details = append(details, fmt.Sprintf("manifest source: %s (%d objects)", *manifestsFlag, len(refs)))
+	} else {
+		details = append(details, "manifest source: live objects labeled heritage=deis")
+	}
+	details = append(details, fmt.Sprintf("delete deployments: %s (replica sets and pods orphaned, they keep running)", strings.Join(pkg.DeletedDeployments, ", ")))
+
+	// The parameters the install was generated from are more complete than what can
+	// be read back from the cluster, but may have drifted from it since.
+	if *paramsFlag != "" {
+		opts.Params, err = ioutil.ReadFile(*paramsFlag)
+		if err != nil {
+			fatalf("Failed to read %s: %v", *paramsFlag, err)
+		}
+	}
+
+	// The migration itself runs in the Migrator. Every secret and deployment it
+	// changes goes into the bundle first, and the probe is checked after every step.
+	var probe *pkg.Probe
+	opts.Hooks = pkg.Hooks{
+		Backup: func(kind, name string, obj interface{}) error {
+			return bundle.AddBackup(kind, name, obj)
+		},
+		AfterStep: func(step string, result *pkg.Result) error {
+			switch step {
+			case pkg.StepValues:
+				for _, key := range result.UnknownParams {
+					log.Printf("unknown key in %s, ignored: %s", *paramsFlag, key)
+				}
+				for _, d := range result.Disagreements {
+					log.Printf("disagreement: %s", d)
+				}
+				fmt.Println(result.RawValues)
+				bundle.Add("values.yaml", []byte(result.RawValues))
+				for _, m := range result.Mutations {
+					log.Printf("planned: %s", m)
+				}
+				if err := confirmMutations(result.Mutations); err != nil {
+					return err
+				}
+				// The probe runs from here on so that every mutation step is covered.
+				// Apps that are unavailable before anything changed stop the migration
+				// right away.
+				if *probeHostsFlag != "" {
+					probe = pkg.NewProbe(*probeRouterFlag, strings.Split(*probeHostsFlag, ","), *probeIntervalFlag, *probeTimeoutFlag, *probeDowntimeFlag)
+					probe.Start()
+				}
+			case pkg.StepManifest:
+				log.Println("generated manifest")
+				log.Println(result.Manifest)
+				bundle.AddManifest(result.Manifest)
+			case pkg.StepRelease:
+				if err := bundle.AddRelease(result.Key, result.Release, target == targetHelm3); err != nil {
+					return fmt.Errorf("adding the release to the bundle: %v", err)
+				}
+			case pkg.StepSupersede:
+				for _, rev := range result.Superseded {
+					log.Printf("superseded %s", rev.Key)
+				}
+			}
+			return probeFailure(probe)
 		},
-		Manifest: manifestDoc.String(),
 	}
-	cfgName := fmt.Sprintf("%s.v%d", releaseName, 1)
-	err = pkg.CfgCreate(cfgName, actualrel, clientset)
+
+	// Existing revisions are checked before anything is changed in the cluster so that
+	// a refused migration leaves the install untouched.
+	migrator := pkg.NewMigrator(clientset, opts)
+	migration, err := migrator.Plan()
+	if exists, ok := err.(*pkg.ReleaseExistsError); ok {
+		fatalf("%v, rerun with --on-existing=%s to write revision %d", exists, existingSupersede, exists.Latest.Version+1)
+	}
 	if err != nil {
-		log.Fatalf("Failed to create configMap: %v", err)
+		fatalf("%v", err)
+	}
+	version := migration.Version
+	plan := []string{
+		fmt.Sprintf("release: %s revision %d (target %s)", releaseName, version, target),
+	}
+	if target == targetHelm2 {
+		plan = append(plan, fmt.Sprintf("tiller storage driver: %s in %s", storage, tillerNamespace))
+	}
+	plan = append(plan, fmt.Sprintf("existing revisions: %d, on-existing: %s", len(migration.Revisions), onExisting))
+	for _, rev := range migration.Deployed() {
+		plan = append(plan, fmt.Sprintf("supersede: %s", rev.Key))
+	}
+	plan = append(plan, details...)
+	log.Println("migration plan:")
+	for _, step := range plan {
+		log.Println("  " + step)
 	}
-}
 
-func deleteDeployments(kubeClient *kubernetes.Clientset) error {
-	deployments := [2]string{"deis-controller", "deis-registry"}
-	for _, deployment := range deployments {
-		err := kubeClient.ExtensionsClient.Deployments("deis").Delete(deployment, &api.DeleteOptions{})
+	// Everything the run produces is kept in an artifact bundle in the cluster, so it
+	// outlives the job's logs. It is saved however the run ends.
+	bundle = pkg.NewBundle(clientset, opts.Namespace, releaseName)
+	bundle.Add("plan.txt", []byte(strings.Join(plan, "\n")+"\n"))
+	if opts.Params != nil {
+		bundle.Add("generate_params.toml", opts.Params)
+	}
+
+	// A broken platform would be baked into the release, and deleting the controller
+	// makes recovering from it harder, so only a healthy install is migrated.
+	if *healthTimeoutFlag > 0 {
+		log.Printf("waiting up to %s for workflow to be healthy", *healthTimeoutFlag)
+		if err := pkg.WaitForHealthy(clientset, opts.Namespace, *healthTimeoutFlag, 5*time.Second); err != nil {
+			fatalf("Refusing to migrate: %v", err)
+		}
+	}
+
+	// The controller is deleted further down, so the on-cluster database has to
+	// have a backup in object storage before anything is changed.
+	backup := "skipped"
+	if *backupTimeoutFlag > 0 {
+		log.Println("backing up the database")
+		backup, err = pkg.BackupDatabase(k8sConfig, clientset, opts.Namespace, strings.Fields(*backupCommandFlag), *backupTimeoutFlag)
+		if err != nil {
+			fatalf("Refusing to migrate without a database backup: %v", err)
+		}
+		log.Printf("database backup: %s", backup)
+	}
+
+	result, err := migrator.Migrate(ctx)
+	if result != nil {
+		for _, status := range result.Secrets {
+			log.Println(status)
+		}
+	}
+	if err != nil {
+		fatalf("Migration failed: %v", err)
+	}
+	actualrel := result.Release
+
+	report := &pkg.Report{Release: releaseName, Revision: version, Target: target, Storage: storage, DatabaseBackup: backup}
+	for _, status := range result.Secrets {
+		if status.Annotated {
+			report.AnnotatedSecrets = append(report.AnnotatedSecrets, status.Name)
+		}
+	}
+	for _, m := range result.Mutations {
+		report.SecretMutations = append(report.SecretMutations, m.String())
+	}
+	report.ParamsDisagreements = result.Disagreements
+	report.ParamsUnknownKeys = result.UnknownParams
+	for _, obj := range opts.Protected {
+		report.Protected = append(report.Protected, obj.String())
+	}
+	for _, rev := range result.Superseded {
+		report.Superseded = append(report.Superseded, rev.Key)
+	}
+
+	// Tiller reading the release back replaces checking `helm list` by hand. The
+	// upgrade, if any, runs while the probe still watches the apps, and the
+	// migration waits for workflow to be healthy again afterwards.
+	if useTiller {
+		tillerVersion, err := pkg.DetectTillerVersion(clientset, tillerNamespace)
+		if err != nil {
+			log.Printf("Failed to detect the tiller version, calling tiller without one: %v", err)
+		}
+		tillerHost := *tillerHostFlag
+		if tillerHost == "" {
+			tillerHost = pkg.TillerServiceHost(tillerNamespace)
+		}
+		var tlsConfig *tls.Config
+		if *tlsFlag || *tlsVerifyFlag {
+			tlsConfig, err = pkg.TillerTLSConfig(*helmHomeFlag, *tlsVerifyFlag)
+			if err != nil {
+				fatalf("%v", err)
+			}
+		}
+		tiller, err := pkg.DialTiller(tillerHost, tillerVersion, tlsConfig, time.Minute)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		defer tiller.Close()
+		status, err := tiller.CheckRelease(releaseName, version)
+		if err != nil {
+			fatalf("Tiller doesn't read the migrated release: %v", err)
+		}
+		log.Printf("tiller reports %s revision %d as %s", releaseName, version, status)
+		report.Tiller = status
+		if *upgradeChartFlag != "" {
+			log.Printf("upgrading %s to %s", releaseName, *upgradeChartFlag)
+			upgraded, err := tiller.UpgradeRelease(actualrel, *upgradeChartFlag, *upgradeTimeoutFlag)
+			if err != nil {
+				fatalf("Failed to upgrade: %v", err)
+			}
+			checkProbe(probe, "upgrading")
+			report.Upgrade = fmt.Sprintf("revision %d", upgraded.Version)
+			if md := upgraded.GetChart().GetMetadata(); md != nil {
+				report.Upgrade += fmt.Sprintf(" (%s)", md.Version)
+			}
+			if err := pkg.WaitForHealthy(clientset, opts.Namespace, *upgradeTimeoutFlag, 5*time.Second); err != nil {
+				fatalf("Workflow isn't healthy after the upgrade: %v", err)
+			}
+			checkProbe(probe, "waiting for the upgrade")
+			log.Printf("upgraded %s to %s", releaseName, report.Upgrade)
+		}
+	}
+
+	if probe != nil {
+		if *probeAfterFlag > 0 {
+			log.Printf("probing for another %s", *probeAfterFlag)
+			deadline := time.Now().Add(*probeAfterFlag)
+			for time.Now().Before(deadline) {
+				time.Sleep(*probeIntervalFlag)
+				checkProbe(probe, "the migration")
+			}
+		}
+		report.Probe = probe.Stop()
+	}
+
+	report.Bundle = bundle.Name
+	writeReport(report)
+
+	// Without the controller and registry nobody can deploy, so if the operator
+	// doesn't get around to `helm upgrade` they are brought back as they were.
+	if *watchdogFlag > 0 && *upgradeChartFlag == "" {
+		log.Printf("watchdog: waiting up to %s for a deployed revision after %d", *watchdogFlag, version)
+		revisions := func() ([]pkg.Revision, error) {
+			if target == targetHelm3 {
+				return pkg.Helm3Revisions(releaseName, opts.Namespace, clientset)
+			}
+			return pkg.TillerRevisions(storage, releaseName, tillerNamespace, clientset)
+		}
+		newer, err := pkg.WaitForRevision(revisions, version, *watchdogFlag, 30*time.Second)
 		if err != nil {
-			return err
+			fatalf("Watchdog failed: %v", err)
+		}
+		if newer > 0 {
+			report.Watchdog = fmt.Sprintf("revision %d was deployed, nothing restored", newer)
+		} else {
+			restored, err := pkg.RestoreDeployments(clientset, opts.Namespace, bundle.Backups("Deployment"))
+			report.Watchdog = fmt.Sprintf("no deployed revision after %d within %s, restored deployments: %s", version, *watchdogFlag, strings.Join(restored, ", "))
+			report.BeforeUpgrade = pkg.CleanupCommands(opts.Namespace, restored)
+			if err != nil {
+				// the deployments restored so far still have to be cleaned up
+				// before the upgrade
+				report.Watchdog += fmt.Sprintf(", failed on the rest: %v", err)
+				writeReport(report)
+				fatalf("Watchdog failed to restore deployments: %v", err)
+			}
+		}
+		log.Printf("watchdog: %s", report.Watchdog)
+		for _, command := range report.BeforeUpgrade {
+			log.Printf("run before `helm upgrade`: %s", command)
 		}
+		writeReport(report)
+	}
+}
+
+// writeReport prints the report and saves it in the bundle, exiting if the bundle
+// can't be saved.
+func writeReport(report *pkg.Report) {
+	out, err := report.YAML()
+	if err != nil {
+		fatalf("Failed to render report: %v", err)
+	}
+	log.Println("migration report:")
+	fmt.Print(out)
+	bundle.Add("report.yaml", []byte(out))
+	if err := saveBundle(); err != nil {
+		releaseLock()
+		os.Exit(1)
+	}
+}
+
+// requiredPermissions lists everything the migration does in the cluster for the
+// given options, with workflow installed in namespace.
+func requiredPermissions(namespace, target, storage, tillerNamespace string, readTiller, keepStateful, backup, watchdog bool, deploymentGroup, daemonSetGroup string) []pkg.Permission {
+	var perms []pkg.Permission
+	perms = append(perms, pkg.Verbs(namespace, "", "configmaps", "get,create,update,delete")...)
+	perms = append(perms, pkg.Verbs(namespace, "", "secrets", "get,list,create,update,patch")...)
+	perms = append(perms, pkg.Verbs(namespace, "", "serviceaccounts", "list")...)
+	perms = append(perms, pkg.Verbs(namespace, "", "services", "get,list")...)
+	perms = append(perms, pkg.Verbs(namespace, "", "pods", "list")...)
+	perms = append(perms, pkg.Verbs(namespace, "", "replicationcontrollers", "list")...)
+	perms = append(perms, pkg.Verbs(namespace, deploymentGroup, "deployments", "get,list,delete")...)
+	perms = append(perms, pkg.Verbs(namespace, daemonSetGroup, "daemonsets", "get,list")...)
+	if keepStateful {
+		perms = append(perms, pkg.Verbs(namespace, "", "persistentvolumeclaims", "get,patch")...)
+	}
+	if backup {
+		// exec over a websocket is authorized as get, over SPDY as create
+		perms = append(perms, pkg.Verbs(namespace, "", "pods/exec", "get,create")...)
+	}
+	if watchdog {
+		perms = append(perms, pkg.Verbs(namespace, deploymentGroup, "deployments", "create")...)
+	}
+	if readTiller {
+		perms = append(perms, pkg.Verbs(tillerNamespace, deploymentGroup, "deployments", "get")...)
+	}
+	switch target {
+	case targetHelm3:
+		perms = append(perms, pkg.Verbs(namespace, "", "secrets", "create")...)
+		perms = append(perms, pkg.Verbs(namespace, "", "serviceaccounts", "patch")...)
+		perms = append(perms, pkg.Verbs(namespace, "", "services", "patch")...)
+		perms = append(perms, pkg.Verbs(namespace, deploymentGroup, "deployments", "patch")...)
+		perms = append(perms, pkg.Verbs(namespace, daemonSetGroup, "daemonsets", "patch")...)
+	case targetHelm2:
+		resource := "configmaps"
+		if storage == pkg.StorageSecret {
+			resource = "secrets"
+		}
+		perms = append(perms, pkg.Verbs(tillerNamespace, "", resource, "get,list,create,update")...)
+	}
+	return perms
+}
+
+// migrationLock is held while the migration runs.
+var migrationLock *pkg.Lock
+
+// lockHolder identifies this run in the migration lock. Pods of a rerun job can
+// share a hostname and a pid, so a random suffix tells the runs apart.
+func lockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		fatalf("Failed to generate a lock holder ID: %v", err)
+	}
+	return fmt.Sprintf("%s/%x", hostname, id)
+}
+
+func releaseLock() {
+	if migrationLock == nil {
+		return
+	}
+	if err := migrationLock.Release(); err != nil {
+		log.Printf("Failed to release migration lock: %v", err)
+	}
+}
+
+// bundle collects the artifacts of the migration, once it is planned.
+var bundle *pkg.Bundle
+
+// saveBundle stores the artifact bundle, if the run got far enough to have one.
+func saveBundle() error {
+	if bundle == nil {
+		return nil
 	}
+	if err := bundle.Save(); err != nil {
+		log.Printf("Failed to save artifact bundle %s: %v", bundle.Name, err)
+		return err
+	}
+	log.Printf("saved artifact bundle to secret %s/%s, download it with `boot fetch %s`", bundle.Namespace(), bundle.Name, bundle.Name)
 	return nil
 }
 
-func getManifest(kubeClient *kubernetes.Clientset, secretsArray []string) (*bytes.Buffer, error) {
-	b := bytes.NewBuffer(nil)
-	labelMap := labels.Set{"heritage": "deis"}
-	var y []byte
+// fatalf saves the artifacts collected so far, along with the error, and releases
+// the migration lock before exiting, so that a failed run doesn't block the next
+// one until the lease expires.
+func fatalf(format string, v ...interface{}) {
+	if bundle != nil {
+		bundle.Add("error.txt", []byte(fmt.Sprintf(format, v...)+"\n"))
+		saveBundle()
+	}
+	releaseLock()
+	log.Fatalf(format, v...)
+}
+
+// confirmMutations asks before the planned secret changes are applied, unless
+// --yes is set. Without a terminal to ask on, the changes are refused.
+func confirmMutations(mutations []pkg.SecretMutation) error {
+	if len(mutations) == 0 || *yesFlag {
+		return nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("%d secret change(s) planned, rerun with --yes to apply them", len(mutations))
+	}
+	fmt.Print("Apply the planned secret changes? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("the planned secret changes weren't confirmed")
+}
+
+// checkProbe aborts the migration if the probe found apps unavailable during step.
+func checkProbe(probe *pkg.Probe, step string) {
+	if err := probeFailure(probe); err != nil {
+		fatalf("Aborting after %s: %v", step, err)
+	}
+}
 
-	// ServiceAccounts
-	serviceAccounts, err := kubeClient.ServiceAccounts("deis").List(api.ListOptions{LabelSelector: labelMap.AsSelector(), FieldSelector: fields.Everything()})
+// probeFailure stops the probe and logs its results if it found apps unavailable.
+func probeFailure(probe *pkg.Probe) error {
+	if probe == nil {
+		return nil
+	}
+	err := probe.Check()
 	if err != nil {
-		return nil, err
+		for _, result := range probe.Stop() {
+			log.Printf("probe %s: %d/%d requests failed, longest outage %s", result.Host, result.Failures, result.Requests, result.LongestOutage)
+		}
+	}
+	return err
+}
+
+// fetch downloads a migration artifact bundle as a tarball.
+func fetch(args []string) {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	kube := newKubeFlags(fs)
+	output := fs.String("o", "", "file to write the tarball to, <bundle name>.tgz if empty, - for stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fetch [flags] [bundle name]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Fetches the named bundle, or the latest one if none is given.\n")
+		fs.PrintDefaults()
 	}
-	for _, serviceAccount := range serviceAccounts.Items {
-		serviceAccountNameDet := strings.SplitN(serviceAccount.ObjectMeta.Name, "-", 2)
-		path := "workflow/charts/" + serviceAccountNameDet[1] + "templates/" + serviceAccountNameDet[1] + "-service-account.yaml"
-		b.WriteString("\n---\n# Source: " + path + "\n")
-		serviceAccount.Kind = "ServiceAccount"
-		serviceAccount.APIVersion = apiVersion
-		serviceAccount.ResourceVersion = ""
-		serviceAccount.Secrets = nil
-		y, err = yaml.Marshal(serviceAccount)
+	fs.Parse(args)
+
+	clientset, err := kube.clientset()
+	if err != nil {
+		log.Fatal(err)
+	}
+	name := fs.Arg(0)
+	if name == "" {
+		name, err = pkg.LatestBundle(clientset, "deis")
 		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			return nil, err
+			log.Fatal(err)
 		}
-		b.WriteString(string(y))
+	}
+	tgz, err := pkg.FetchBundle(clientset, "deis", name)
+	if err != nil {
+		log.Fatalf("Failed to fetch bundle %s: %v", name, err)
 	}
 
-	// Secrets
-	secretsMap := make(map[string]struct{})
-	for _, secret := range secretsArray {
-		secretsMap[secret] = struct{}{}
+	if *output == "-" {
+		os.Stdout.Write(tgz)
+		return
+	}
+	file := *output
+	if file == "" {
+		file = name + ".tgz"
+	}
+	if err := ioutil.WriteFile(file, tgz, 0600); err != nil {
+		log.Fatalf("Failed to write %s: %v", file, err)
 	}
-	secrets, err := kubeClient.Secrets("deis").List(api.ListOptions{LabelSelector: labelMap.AsSelector(), FieldSelector: fields.Everything()})
+	log.Printf("wrote bundle %s to %s", name, file)
+}
+
+// inspect prints a release stored by Tiller, either read from the cluster or from
+// a ConfigMap or Secret exported to a file.
+func inspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	tiller := newTillerFlags(fs)
+	revision := fs.Int("revision", 0, "revision to inspect, the latest if 0")
+	file := fs.String("f", "", "read the release from an exported ConfigMap or Secret instead of the cluster")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s inspect [flags] [release name]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	rls, err := loadRelease(tiller, *file, targetHelm2, releaseArg(fs), int32(*revision))
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
+	}
+	out, err := pkg.FormatRelease(rls)
+	if err != nil {
+		log.Fatalf("Failed to format release: %v", err)
 	}
-	for _, secret := range secrets.Items {
-		if _, ok := secretsMap[secret.ObjectMeta.GetName()]; ok {
-			continue
+	fmt.Print(out)
+}
+
+// verify checks the latest revision of the workflow release after `helm upgrade`
+// and exits non-zero listing every problem found.
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	tiller := newTillerFlags(fs)
+	target := fs.String("target", getenv("MIGRATION_TARGET", targetHelm2), "release format to read: helm2 from tiller's storage or helm3 from the deis namespace")
+	controllerURL := fs.String("controller-url", getenv("CONTROLLER_URL", ""), "controller health endpoint, http://deis-controller.deis/healthz inside the cluster; outside it the controller isn't checked unless this is set")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify [flags] [release name]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	// The in-cluster service name only resolves from a pod, e.g. not from the
+	// helm plugin on a workstation.
+	if *controllerURL == "" {
+		if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+			*controllerURL = "http://deis-controller.deis/healthz"
+		} else {
+			log.Println("not checking the controller outside the cluster, set --controller-url to its public health endpoint to check it")
 		}
-		secretNameDet := strings.SplitN(secret.ObjectMeta.Name, "-", 2)
-		path := "workflow/charts/" + secretNameDet[1] + "templates/" + secretNameDet[1] + "-secret.yaml"
-		b.WriteString("\n---\n# Source: " + path + "\n")
-		secret.Kind = "Secret"
-		secret.APIVersion = apiVersion
-		secret.ResourceVersion = ""
-		y, err = yaml.Marshal(secret)
-		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			return nil, err
+	}
+	rls, err := loadRelease(tiller, "", *target, releaseArg(fs), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := tiller.clientset()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("verifying %s revision %d (%s)", rls.Name, rls.Version, rls.Chart.Metadata.Version)
+	problems, unchecked, err := pkg.Verify(clientset, rls, *controllerURL)
+	if err != nil {
+		log.Fatalf("Failed to verify release: %v", err)
+	}
+	for _, obj := range unchecked {
+		fmt.Printf("%s: not checked\n", obj)
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
 		}
-		b.WriteString(string(y))
+		log.Fatalf("%d problem(s) found", len(problems))
+	}
+	log.Println("release verified")
+}
+
+// conflicts compares the stored release with the rendered manifest of the chart it
+// is about to be upgraded to, and lists every object the upgrade would fail to
+// patch along with what to do before upgrading. It exits non-zero if there are any.
+func conflicts(args []string) {
+	fs := flag.NewFlagSet("conflicts", flag.ExitOnError)
+	tiller := newTillerFlags(fs)
+	revision := fs.Int("revision", 0, "revision to compare, the latest if 0")
+	file := fs.String("f", "", "read the release from an exported ConfigMap or Secret instead of the cluster")
+	rendered := fs.String("rendered", "", "the rendered manifest of the target chart, e.g. the output of `helm template`, - for stdin")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s conflicts --rendered <manifest> [flags] [release name]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *rendered == "" {
+		fs.Usage()
+		os.Exit(2)
 	}
 
-	// Services
-	services, err := kubeClient.Services("deis").List(api.ListOptions{LabelSelector: labelMap.AsSelector(), FieldSelector: fields.Everything()})
+	var manifest []byte
+	var err error
+	if *rendered == "-" {
+		manifest, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		manifest, err = ioutil.ReadFile(*rendered)
+	}
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to read %s: %v", *rendered, err)
 	}
-	for _, service := range services.Items {
-		serviceNameDet := strings.SplitN(service.ObjectMeta.Name, "-", 2)
-		path := "workflow/charts/" + serviceNameDet[1] + "templates/" + serviceNameDet[1] + "-service.yaml"
-		b.WriteString("\n---\n# Source: " + path + "\n")
-		service.Kind = "Service"
-		service.APIVersion = apiVersion
-		service.ResourceVersion = ""
-		service.Spec.ClusterIP = ""
-		y, err = yaml.Marshal(service)
-		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			return nil, err
+
+	rls, err := loadRelease(tiller, *file, targetHelm2, releaseArg(fs), int32(*revision))
+	if err != nil {
+		log.Fatal(err)
+	}
+	found, err := pkg.FindConflicts(rls.Manifest, string(manifest), rls.Namespace)
+	if err != nil {
+		log.Fatalf("Failed to compare manifests: %v", err)
+	}
+	if len(found) > 0 {
+		for _, c := range found {
+			fmt.Println(c)
 		}
-		b.WriteString(string(y))
+		log.Fatalf("%d conflict(s) found with %s revision %d", len(found), rls.Name, rls.Version)
 	}
-	// deis-logger-redis service has label `heritage: helm` and hence needs to be manually queried.
-	service, err := kubeClient.Services("deis").Get("deis-logger-redis")
-	if err != nil && !apierrors.IsNotFound(err) {
-		return nil, err
+	log.Printf("no conflicts with %s revision %d", rls.Name, rls.Version)
+}
+
+// kubeFlags are the flags of every command that talks to the cluster.
+type kubeFlags struct {
+	kubeconfig  *string
+	kubeContext *string
+}
+
+func newKubeFlags(fs *flag.FlagSet) *kubeFlags {
+	return &kubeFlags{
+		kubeconfig:  fs.String("kubeconfig", getenv("KUBECONFIG", ""), "path to a kubeconfig file, the in-cluster config is used inside a pod and ~/.kube/config elsewhere if empty"),
+		kubeContext: fs.String("kube-context", getenv("HELM_KUBECONTEXT", ""), "kubeconfig context to use, the current context if empty"),
+	}
+}
+
+func (f *kubeFlags) clientset() (kubernetes.Interface, error) {
+	return newClientset(*f.kubeconfig, *f.kubeContext)
+}
+
+// tillerFlags are the flags of every command that reads or writes the releases
+// Tiller stores.
+type tillerFlags struct {
+	kubeFlags
+	storage   *string
+	namespace *string
+}
+
+func newTillerFlags(fs *flag.FlagSet) *tillerFlags {
+	return &tillerFlags{
+		kubeFlags: *newKubeFlags(fs),
+		storage:   fs.String("tiller-storage", getenv("TILLER_STORAGE", ""), "tiller storage driver: configmap or secret (detected from tiller-deploy if empty)"),
+		namespace: fs.String("tiller-namespace", getenv("TILLER_NAMESPACE", pkg.DefaultTillerNamespace), "namespace tiller runs and stores releases in"),
 	}
-	if err == nil {
-		serviceNameDet := strings.SplitN(service.ObjectMeta.Name, "-", 2)
-		path := "workflow/charts/" + serviceNameDet[1] + "templates/" + serviceNameDet[1] + "-service.yaml"
-		b.WriteString("\n---\n# Source: " + path + "\n")
-		service.Kind = "Service"
-		service.APIVersion = apiVersion
-		service.ResourceVersion = ""
-		service.Spec.ClusterIP = ""
-		y, err = yaml.Marshal(service)
+}
+
+// releaseArg returns the release name given as the command's argument, or the
+// one the chart sets.
+func releaseArg(fs *flag.FlagSet) string {
+	if fs.NArg() > 0 {
+		return fs.Arg(0)
+	}
+	return getenv("RELEASE_NAME", "deis-workflow")
+}
+
+// loadRelease reads the release from the ConfigMap or Secret exported to file if
+// one is given, and otherwise the given revision of the release from the cluster,
+// the latest if revision is 0. Helm 3 releases are read from the deis namespace.
+func loadRelease(f *tillerFlags, file, target, releaseName string, revision int32) (*rspb.Release, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", file, err)
+		}
+		rls, err := pkg.ReadStoredRelease(data)
 		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			return nil, err
+			return nil, fmt.Errorf("Failed to decode release from %s: %v", file, err)
 		}
-		b.WriteString(string(y))
+		return rls, nil
 	}
-
-	// Deployments
-	deployments, err := kubeClient.Extensions().Deployments("deis").List(api.ListOptions{LabelSelector: labelMap.AsSelector(), FieldSelector: fields.Everything()})
+	if target != targetHelm2 && target != targetHelm3 {
+		return nil, fmt.Errorf("Unknown target %q, must be %q or %q", target, targetHelm2, targetHelm3)
+	}
+	clientset, err := f.clientset()
 	if err != nil {
 		return nil, err
 	}
-	for _, deployment := range deployments.Items {
-		deploymentNameDet := strings.SplitN(deployment.ObjectMeta.Name, "-", 2)
-		path := "workflow/charts/" + deploymentNameDet[1] + "templates/" + deploymentNameDet[1] + "-deployment.yaml"
-		b.WriteString("\n---\n# Source: " + path + "\n")
-		deployment.Kind = "Deployment"
-		deployment.APIVersion = "extensions/v1beta1"
-		deployment.ResourceVersion = ""
-		y, err = yaml.Marshal(deployment)
+	if target == targetHelm3 {
+		return storedHelm3Release(clientset, "deis", releaseName, revision)
+	}
+	return storedRelease(clientset, *f.storage, *f.namespace, releaseName, revision)
+}
+
+// storedRelease returns the given revision of the release from Tiller's storage, or
+// the latest one if revision is 0. The storage driver is detected if not set.
+func storedRelease(clientset kubernetes.Interface, storage, tillerNamespace, releaseName string, revision int32) (*rspb.Release, error) {
+	var err error
+	if storage == "" {
+		storage, err = pkg.DetectTillerStorage(clientset, tillerNamespace)
 		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			return nil, err
+			return nil, fmt.Errorf("Failed to detect tiller storage driver, set it with --tiller-storage: %v", err)
 		}
-		b.WriteString(string(y))
 	}
-
-	// DaemonSets
-	daemonsets, err := kubeClient.Extensions().DaemonSets("deis").List(api.ListOptions{LabelSelector: labelMap.AsSelector(), FieldSelector: fields.Everything()})
+	key := fmt.Sprintf("%s.v%d", releaseName, revision)
+	if revision == 0 {
+		revisions, err := pkg.TillerRevisions(storage, releaseName, tillerNamespace, clientset)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list revisions of %s: %v", releaseName, err)
+		}
+		if len(revisions) == 0 {
+			return nil, fmt.Errorf("Release %s not found in tiller %s storage", releaseName, storage)
+		}
+		key = revisions[len(revisions)-1].Key
+	}
+	rls, err := pkg.GetStoredRelease(storage, key, tillerNamespace, clientset)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Failed to get release %s: %v", key, err)
 	}
-	for _, daemonset := range daemonsets.Items {
-		daemonsetNameDet := strings.SplitN(daemonset.ObjectMeta.Name, "-", 2)
-		path := "workflow/charts/" + daemonsetNameDet[1] + "templates/" + daemonsetNameDet[1] + "-daemonset.yaml"
-		b.WriteString("\n---\n# Source: " + path + "\n")
-		daemonset.Kind = "DaemonSet"
-		daemonset.APIVersion = "extensions/v1beta1"
-		daemonset.ResourceVersion = ""
-		y, err = yaml.Marshal(daemonset)
+	return rls, nil
+}
+
+// storedHelm3Release returns the given revision of a Helm 3 release from namespace,
+// or the latest one if revision is 0.
+func storedHelm3Release(clientset kubernetes.Interface, namespace, releaseName string, revision int32) (*rspb.Release, error) {
+	key := pkg.Helm3SecretName(releaseName, revision)
+	if revision == 0 {
+		revisions, err := pkg.Helm3Revisions(releaseName, namespace, clientset)
 		if err != nil {
-			fmt.Printf("err: %v\n", err)
-			return nil, err
+			return nil, fmt.Errorf("Failed to list revisions of %s: %v", releaseName, err)
 		}
-		b.WriteString(string(y))
+		if len(revisions) == 0 {
+			return nil, fmt.Errorf("Helm 3 release %s not found in %s", releaseName, namespace)
+		}
+		key = revisions[len(revisions)-1].Key
 	}
+	rls, err := pkg.GetHelm3Release(key, namespace, clientset)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get release %s: %v", key, err)
+	}
+	return rls, nil
+}
 
-	return b, err
+// newConfig creates a client config from the kubeconfig file if one is given or
+// a context is named, from the in-cluster config when running in a pod, and from
+// the kubeconfig files kubectl reads otherwise, e.g. when run as a helm plugin.
+func newConfig(kubeconfig, kubeContext string) (*rest.Config, error) {
+	var k8sConfig *rest.Config
+	var err error
+	if kubeconfig == "" && kubeContext == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		// creates the in-cluster config
+		k8sConfig, err = rest.InClusterConfig()
+	} else {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		if strings.Contains(kubeconfig, string(os.PathListSeparator)) {
+			rules.Precedence = filepath.SplitList(kubeconfig)
+		} else {
+			rules.ExplicitPath = kubeconfig
+		}
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+		k8sConfig, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get config: %v", err)
+	}
+	return k8sConfig, nil
+}
+
+// newClientset creates a clientset from the config newConfig finds.
+func newClientset(kubeconfig, kubeContext string) (kubernetes.Interface, error) {
+	k8sConfig, err := newConfig(kubeconfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	// creates the clientset
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create client: %v", err)
+	}
+	return clientset, nil
 }
 
 func getenv(name, dfault string) string {
@@ -244,3 +1000,11 @@ func getenv(name, dfault string) string {
 	}
 	return value
 }
+
+func getenvDuration(name string, dfault time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		value = dfault
+	}
+	return value
+}
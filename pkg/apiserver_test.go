@@ -0,0 +1,303 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"k8s.io/client-go/1.5/kubernetes"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/unversioned"
+	"k8s.io/client-go/1.5/rest"
+)
+
+// testServer is an in-memory API server that keeps objects as JSON, so that code
+// taking a real clientset can be tested against it. It understands create, get,
+// list with label selectors, update, merge patches and delete on any resource
+// path, serves the API groups it is told about for discovery, and can be told to
+// fail requests.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]map[string]interface{}
+	version  int
+	failures map[string][]*apierrors.StatusError
+	requests []string
+	groups   []unversioned.APIGroup
+	served   map[string][]unversioned.APIResource
+}
+
+// newTestServer starts a test server and returns it with a clientset talking to it.
+func newTestServer(t *testing.T) (*testServer, *kubernetes.Clientset) {
+	s := &testServer{
+		objects:  make(map[string]map[string]interface{}),
+		failures: make(map[string][]*apierrors.StatusError),
+		served:   make(map[string][]unversioned.APIResource),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: s.URL, QPS: 1000, Burst: 1000})
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, clientset
+}
+
+// add stores obj in the collection at path, e.g. /api/v1/namespaces/deis/secrets.
+func (s *testServer) add(t *testing.T, path string, obj interface{}) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store(path, m)
+}
+
+// get returns the stored object at path, or nil.
+func (s *testServer) get(path string) map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[path]
+}
+
+// discover makes the server advertise groupVersion, e.g. apps/v1, as serving the
+// given kinds. The first version added for a group is its preferred version.
+func (s *testServer) discover(groupVersion string, kinds ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	gv := strings.SplitN(groupVersion, "/", 2)
+	version := unversioned.GroupVersionForDiscovery{GroupVersion: groupVersion, Version: gv[1]}
+	found := false
+	for i := range s.groups {
+		if s.groups[i].Name == gv[0] {
+			s.groups[i].Versions = append(s.groups[i].Versions, version)
+			found = true
+		}
+	}
+	if !found {
+		s.groups = append(s.groups, unversioned.APIGroup{Name: gv[0], Versions: []unversioned.GroupVersionForDiscovery{version}, PreferredVersion: version})
+	}
+	for _, kind := range kinds {
+		resource := strings.ToLower(kind) + "s"
+		if strings.HasSuffix(kind, "s") {
+			resource = strings.ToLower(kind) + "es"
+		}
+		s.served[groupVersion] = append(s.served[groupVersion], unversioned.APIResource{Name: resource, Namespaced: true, Kind: kind})
+	}
+}
+
+// failNext makes the next requests with the given method and path fail with errs,
+// one error per request.
+func (s *testServer) failNext(method, path string, errs ...*apierrors.StatusError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method+" "+path] = append(s.failures[method+" "+path], errs...)
+}
+
+// count returns how many requests were made with the given method and path.
+func (s *testServer) count(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range s.requests {
+		if r == method+" "+path {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *testServer) store(collection string, obj map[string]interface{}) string {
+	metadata := mapField(obj, "metadata")
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+		obj["metadata"] = metadata
+	}
+	if ns := namespaceOf(collection); ns != "" {
+		metadata["namespace"] = ns
+	}
+	s.version++
+	metadata["resourceVersion"] = strconv.Itoa(s.version)
+	name, _ := metadata["name"].(string)
+	s.objects[collection+"/"+name] = obj
+	return collection + "/" + name
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.Method + " " + r.URL.Path
+	s.requests = append(s.requests, key)
+	if errs := s.failures[key]; len(errs) > 0 {
+		s.failures[key] = errs[1:]
+		writeStatus(w, errs[0])
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/api" {
+		writeJSON(w, http.StatusOK, unversioned.APIVersions{Versions: []string{"v1"}})
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/apis" {
+		writeJSON(w, http.StatusOK, unversioned.APIGroupList{Groups: s.groups})
+		return
+	}
+	if resources, ok := s.served[strings.TrimPrefix(r.URL.Path, "/apis/")]; ok && r.Method == "GET" {
+		writeJSON(w, http.StatusOK, unversioned.APIResourceList{GroupVersion: strings.TrimPrefix(r.URL.Path, "/apis/"), APIResources: resources})
+		return
+	}
+	collection, name := splitPath(r.URL.Path)
+	path := collection + "/" + name
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	obj := make(map[string]interface{})
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &obj); err != nil {
+			writeStatus(w, apierrors.NewBadRequest(err.Error()))
+			return
+		}
+	}
+	resource := unversioned.GroupResource{Resource: collection[strings.LastIndex(collection, "/")+1:]}
+	existing, found := s.objects[path]
+	switch {
+	case r.Method == "GET" && name == "":
+		writeJSON(w, http.StatusOK, s.list(collection, r.URL.Query().Get("labelSelector")))
+	case r.Method == "POST" && name == "":
+		name, _ = mapField(obj, "metadata")["name"].(string)
+		if _, ok := s.objects[collection+"/"+name]; ok {
+			writeStatus(w, apierrors.NewAlreadyExists(resource, name))
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.objects[s.store(collection, obj)])
+	case !found:
+		writeStatus(w, apierrors.NewNotFound(resource, name))
+	case r.Method == "GET":
+		writeJSON(w, http.StatusOK, existing)
+	case r.Method == "PUT":
+		if rv, _ := mapField(obj, "metadata")["resourceVersion"].(string); rv != "" && rv != mapField(existing, "metadata")["resourceVersion"] {
+			writeStatus(w, apierrors.NewConflict(resource, name, nil))
+			return
+		}
+		writeJSON(w, http.StatusOK, s.objects[s.store(collection, obj)])
+	case r.Method == "PATCH":
+		mergePatch(existing, obj)
+		writeJSON(w, http.StatusOK, s.objects[s.store(collection, existing)])
+	case r.Method == "DELETE":
+		delete(s.objects, path)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Success"})
+	default:
+		writeStatus(w, apierrors.NewMethodNotSupported(resource, r.Method))
+	}
+}
+
+// list returns the objects of collection whose labels match selector, which holds
+// comma separated key=value pairs.
+func (s *testServer) list(collection, selector string) map[string]interface{} {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, collection+"/") && !strings.Contains(key[len(collection)+1:], "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	items := []interface{}{}
+	for _, key := range keys {
+		obj := s.objects[key]
+		labels := mapField(mapField(obj, "metadata"), "labels")
+		matches := true
+		for _, term := range strings.Split(selector, ",") {
+			if kv := strings.SplitN(term, "=", 2); len(kv) == 2 && labels[kv[0]] != kv[1] {
+				matches = false
+			}
+		}
+		if matches {
+			items = append(items, obj)
+		}
+	}
+	return map[string]interface{}{"metadata": map[string]interface{}{}, "items": items}
+}
+
+// splitPath splits the path of a request into the collection and the object name,
+// which is empty for requests to the collection.
+func splitPath(path string) (string, string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	// /api/v1/... or /apis/<group>/<version>/...
+	prefix := 2
+	if parts[0] == "apis" {
+		prefix = 3
+	}
+	if len(parts) < prefix {
+		return path, ""
+	}
+	rest := parts[prefix:]
+	if len(rest) >= 3 && rest[0] == "namespaces" {
+		prefix += 2
+		rest = rest[2:]
+	}
+	if len(rest) < 2 {
+		return "/" + strings.Join(parts, "/"), ""
+	}
+	return "/" + strings.Join(parts[:prefix+1], "/"), strings.Join(rest[1:], "/")
+}
+
+func namespaceOf(collection string) string {
+	parts := strings.Split(collection, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "namespaces" && i+2 < len(parts) {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// mergePatch applies a JSON merge patch to obj.
+func mergePatch(obj, patch map[string]interface{}) {
+	for key, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			delete(obj, key)
+		case map[string]interface{}:
+			target, ok := obj[key].(map[string]interface{})
+			if !ok {
+				target = make(map[string]interface{})
+				obj[key] = target
+			}
+			mergePatch(target, v)
+		default:
+			obj[key] = v
+		}
+	}
+}
+
+func writeStatus(w http.ResponseWriter, err *apierrors.StatusError) {
+	status := err.ErrStatus
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	writeJSON(w, int(status.Code), status)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// mapField returns the map held by m[key], or nil.
+func mapField(m map[string]interface{}, key string) map[string]interface{} {
+	v, _ := m[key].(map[string]interface{})
+	return v
+}
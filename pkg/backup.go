@@ -0,0 +1,333 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	swiftclient "github.com/ncw/swift"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.5/pkg/labels"
+	"k8s.io/client-go/1.5/rest"
+)
+
+const (
+	// walePrefix is where WAL-E keeps base backups in the database bucket. Each
+	// finished backup has a sentinel object named after it.
+	walePrefix     = "basebackups_005/"
+	waleSentinel   = "_backup_stop_sentinel.json"
+	azureVersion   = "2015-04-05"
+	databaseLabel  = "deis-database"
+	gcsReadOnly    = "https://www.googleapis.com/auth/devstorage.read_only"
+	backupPollWait = 5 * time.Second
+)
+
+// DatabaseLocation returns whether the controller uses the on-cluster database or
+// an off-cluster one, without changing anything.
+func DatabaseLocation(kubeClient kubernetes.Interface, namespace string) (string, error) {
+	controllerDeployment := &v1beta1.Deployment{}
+	if err := getObject(kubeClient, "Deployment", namespace, "deis-controller", controllerDeployment); err != nil {
+		return "", err
+	}
+	for _, env := range controllerDeployment.Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "DEIS_DATABASE_NAME" && env.Value != "" {
+			return offCluster, nil
+		}
+	}
+	return onCluster, nil
+}
+
+// BackupDatabase has the on-cluster database push a base backup to object storage
+// by running command in the deis-database pod in namespace. It then waits up to timeout for a
+// backup that wasn't in the database bucket before to show up, and describes it.
+// An off-cluster database isn't backed up.
+func BackupDatabase(config *rest.Config, kubeClient kubernetes.Interface, namespace string, command []string, timeout time.Duration) (string, error) {
+	location, err := DatabaseLocation(kubeClient, namespace)
+	if err != nil {
+		return "", err
+	}
+	if location == offCluster {
+		return "skipped, the database is off-cluster", nil
+	}
+	v := &Values{namespace: namespace}
+	if err := v.updateStorageparams(kubeClient); err != nil {
+		return "", err
+	}
+	before, err := listBackups(v)
+	if err != nil {
+		return "", fmt.Errorf("listing %s: %v", databaseBucket(v), err)
+	}
+
+	pod, err := databasePod(kubeClient, namespace)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ExecInPod(config, namespace, pod, command); err != nil {
+		return "", err
+	}
+
+	// listings of some stores are eventually consistent
+	deadline := time.Now().Add(timeout)
+	for {
+		after, err := listBackups(v)
+		if err != nil {
+			return "", fmt.Errorf("listing %s: %v", databaseBucket(v), err)
+		}
+		if backup := newBackup(before, after); backup != "" {
+			return fmt.Sprintf("base backup %s in %s", backup, databaseBucket(v)), nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no new base backup in %s after %s", databaseBucket(v), timeout)
+		}
+		time.Sleep(backupPollWait)
+	}
+}
+
+// newBackup returns the name of a backup in after that isn't in before.
+func newBackup(before, after []string) string {
+	existing := make(map[string]struct{})
+	for _, name := range before {
+		existing[name] = struct{}{}
+	}
+	var added []string
+	for _, name := range after {
+		if _, ok := existing[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	if len(added) == 0 {
+		return ""
+	}
+	sort.Strings(added)
+	return added[len(added)-1]
+}
+
+func databasePod(kubeClient kubernetes.Interface, namespace string) (string, error) {
+	pods, err := kubeClient.Core().Pods(namespace).List(api.ListOptions{LabelSelector: labels.Set{"app": databaseLabel}.AsSelector()})
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodRunning {
+			return pod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no running %s pod", databaseLabel)
+}
+
+func databaseBucket(v *Values) string {
+	switch v.StorageLocation {
+	case "s3":
+		return "s3 bucket " + v.S3.DatabaseBucket
+	case "gcs":
+		return "gcs bucket " + v.GCS.DatabaseBucket
+	case "azure":
+		return "azure container " + v.Azure.DatabaseContainer
+	case "swift":
+		return "swift container " + v.Swift.DatabaseContainer
+	}
+	return v.StorageLocation
+}
+
+// listBackups returns the names of the finished base backups in the database
+// bucket of the storage backend.
+func listBackups(v *Values) ([]string, error) {
+	var names []string
+	var err error
+	switch v.StorageLocation {
+	case "s3":
+		names, err = listS3(v.S3, walePrefix)
+	case "gcs":
+		names, err = listGCS(v.GCS, walePrefix)
+	case "azure":
+		names, err = listAzure(v.Azure, walePrefix)
+	case "swift":
+		names, err = listSwift(v.Swift, walePrefix)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend %q", v.StorageLocation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, name := range names {
+		if strings.HasSuffix(name, waleSentinel) {
+			backups = append(backups, strings.TrimSuffix(strings.TrimPrefix(name, walePrefix), waleSentinel))
+		}
+	}
+	return backups, nil
+}
+
+func listS3(params s3, prefix string) ([]string, error) {
+	config := &aws.Config{Region: aws.String(params.Region)}
+	if params.Region == "" {
+		config.Region = aws.String("us-east-1")
+	}
+	// without keys the instance role is used, as the database does
+	if params.AccessKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(params.AccessKey, params.SecretKey, "")
+	}
+	svc := awss3.New(session.New(config))
+	var names []string
+	err := svc.ListObjectsPages(&awss3.ListObjectsInput{
+		Bucket: aws.String(params.DatabaseBucket),
+		Prefix: aws.String(prefix),
+	}, func(page *awss3.ListObjectsOutput, last bool) bool {
+		for _, obj := range page.Contents {
+			names = append(names, aws.StringValue(obj.Key))
+		}
+		return true
+	})
+	return names, err
+}
+
+func listGCS(params gcs, prefix string) ([]string, error) {
+	conf, err := google.JWTConfigFromJSON([]byte(params.KeyJSON), gcsReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	client := conf.Client(context.Background())
+	var names []string
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {prefix}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		resp, err := client.Get("https://www.googleapis.com/storage/v1/b/" + url.QueryEscape(params.DatabaseBucket) + "/o?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		page := struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}{}
+		err = decodeResponse(resp, func() error { return json.NewDecoder(resp.Body).Decode(&page) })
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			names = append(names, item.Name)
+		}
+		if page.NextPageToken == "" {
+			return names, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func listAzure(params azure, prefix string) ([]string, error) {
+	key, err := base64.StdEncoding.DecodeString(params.AccountKey)
+	if err != nil {
+		return nil, fmt.Errorf("decoding account key: %v", err)
+	}
+	var names []string
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		u := fmt.Sprintf("https://%s.blob.core.windows.net/%s?%s", params.AccountName, params.DatabaseContainer, query.Encode())
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		req.Header.Set("x-ms-version", azureVersion)
+		req.Header.Set("Authorization", "SharedKey "+params.AccountName+":"+azureSignature(key, params.AccountName, params.DatabaseContainer, req.Header, query))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		page := struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}{}
+		err = decodeResponse(resp, func() error { return xml.NewDecoder(resp.Body).Decode(&page) })
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range page.Blobs {
+			names = append(names, blob.Name)
+		}
+		if page.NextMarker == "" {
+			return names, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+// azureSignature signs a GET request on a container with the storage account key,
+// as described in "Authentication for the Azure Storage Services".
+func azureSignature(key []byte, account, container string, header http.Header, query url.Values) string {
+	// GET with no content, conditional or range headers; x-ms-date replaces Date
+	toSign := "GET\n\n\n\n\n\n\n\n\n\n\n\n"
+	toSign += "x-ms-date:" + header.Get("x-ms-date") + "\n"
+	toSign += "x-ms-version:" + header.Get("x-ms-version") + "\n"
+	toSign += "/" + account + "/" + container
+	params := make([]string, 0, len(query))
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		toSign += "\n" + strings.ToLower(name) + ":" + strings.Join(query[name], ",")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func listSwift(params swift, prefix string) ([]string, error) {
+	authVersion := 0
+	if params.AuthVersion != "" {
+		var err error
+		if authVersion, err = strconv.Atoi(params.AuthVersion); err != nil {
+			return nil, fmt.Errorf("invalid auth version %q", params.AuthVersion)
+		}
+	}
+	conn := swiftclient.Connection{
+		UserName:    params.UserName,
+		ApiKey:      params.Password,
+		AuthUrl:     params.AuthURL,
+		Tenant:      params.Tenant,
+		AuthVersion: authVersion,
+	}
+	if err := conn.Authenticate(); err != nil {
+		return nil, err
+	}
+	return conn.ObjectNamesAll(params.DatabaseContainer, &swiftclient.ObjectsOpts{Prefix: prefix})
+}
+
+// decodeResponse closes the response body after decoding it, and turns a status
+// other than 200 into an error.
+func decodeResponse(resp *http.Response, decode func() error) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return decode()
+}
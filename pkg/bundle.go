@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/labels"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+const (
+	// BundlePrefix starts the name of every artifact bundle secret.
+	BundlePrefix   = "workflow-migration-bundle-"
+	bundleKey      = "bundle.tgz"
+	bundleLabel    = "workflow-migration-bundle"
+	maxSecretBytes = 1024 * 1024
+)
+
+var sourceLine = regexp.MustCompile(`(?m)^# Source: (.*)$`)
+
+// Bundle collects the artifacts of a migration run: the values, the manifest split
+// by source path, the encoded release, backups of the objects changed or deleted,
+// and the report. It is stored as a gzipped tarball in a secret.
+type Bundle struct {
+	Name       string
+	kubeClient kubernetes.Interface
+	namespace  string
+	release    string
+	created    time.Time
+
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewBundle returns an empty bundle for a run migrating release, to be saved in
+// namespace.
+func NewBundle(kubeClient kubernetes.Interface, namespace, release string) *Bundle {
+	now := time.Now().UTC()
+	return &Bundle{
+		Name:       BundlePrefix + now.Format("20060102-150405"),
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		release:    release,
+		created:    now,
+		files:      make(map[string][]byte),
+	}
+}
+
+// Namespace returns the namespace the bundle is saved in.
+func (b *Bundle) Namespace() string {
+	return b.namespace
+}
+
+// Add stores a file in the bundle, replacing a file of the same name.
+func (b *Bundle) Add(name string, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[name] = data
+}
+
+// AddManifest stores every document of the manifest under manifest/ at its source
+// path. Documents sharing a source path end up in the same file.
+func (b *Bundle) AddManifest(manifest string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, doc := range docSeparator.Split(manifest, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		source := "unknown.yaml"
+		if match := sourceLine.FindStringSubmatch(doc); match != nil {
+			source = strings.TrimSpace(match[1])
+		}
+		name := path.Join("manifest", path.Clean("/"+source))
+		if existing, ok := b.files[name]; ok {
+			b.files[name] = append(existing, []byte("---\n"+strings.TrimLeft(doc, "\n"))...)
+			continue
+		}
+		b.files[name] = []byte(strings.TrimLeft(doc, "\n"))
+	}
+}
+
+// AddRelease stores the release encoded the way it is written to storage, under
+// release/key.
+func (b *Bundle) AddRelease(key string, rls *rspb.Release, helm3 bool) error {
+	var data string
+	var err error
+	if helm3 {
+		data, err = encodeHelm3Release(rls)
+	} else {
+		data, err = encodeRelease(rls)
+	}
+	if err != nil {
+		return err
+	}
+	b.Add(path.Join("release", key), []byte(data))
+	return nil
+}
+
+// AddBackup stores obj as YAML under backups/.
+func (b *Bundle) AddBackup(kind, name string, obj interface{}) error {
+	y, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	b.Add(path.Join("backups", strings.ToLower(kind)+"-"+name+".yaml"), y)
+	return nil
+}
+
+// Backups returns the backups of the objects of kind, by name.
+func (b *Bundle) Backups(kind string) map[string][]byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prefix := path.Join("backups", strings.ToLower(kind)) + "-"
+	backups := make(map[string][]byte)
+	for name, data := range b.files {
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".yaml") {
+			backups[strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".yaml")] = data
+		}
+	}
+	return backups
+}
+
+// Tarball returns the files of the bundle as a gzipped tarball, in a directory
+// named after the bundle.
+func (b *Bundle) Tarball() ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.files))
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		data := b.files[name]
+		hdr := &tar.Header{
+			Name:    path.Join(b.Name, name),
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: b.created,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Save stores the bundle in a secret named after it, replacing the secret if the
+// bundle was saved before.
+func (b *Bundle) Save() error {
+	tgz, err := b.Tarball()
+	if err != nil {
+		return err
+	}
+	if len(tgz) > maxSecretBytes {
+		return fmt.Errorf("bundle is %d bytes, more than a secret can hold", len(tgz))
+	}
+	secret := &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name: b.Name,
+			Labels: map[string]string{
+				"heritage":  "workflow-migration",
+				bundleLabel: "true",
+				"release":   b.release,
+			},
+		},
+		Data: map[string][]byte{bundleKey: tgz},
+	}
+	if _, err := b.kubeClient.Core().Secrets(b.namespace).Create(secret); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		_, err = b.kubeClient.Core().Secrets(b.namespace).Update(secret)
+		return err
+	}
+	return nil
+}
+
+// LatestBundle returns the name of the most recently created bundle.
+func LatestBundle(kubeClient kubernetes.Interface, namespace string) (string, error) {
+	list, err := kubeClient.Core().Secrets(namespace).List(api.ListOptions{LabelSelector: labels.Set{bundleLabel: "true"}.AsSelector()})
+	if err != nil {
+		return "", err
+	}
+	if len(list.Items) == 0 {
+		return "", fmt.Errorf("no migration bundle in namespace %s", namespace)
+	}
+	// the names sort by the time they were created
+	names := make([]string, 0, len(list.Items))
+	for _, item := range list.Items {
+		names = append(names, item.Name)
+	}
+	sort.Strings(names)
+	return names[len(names)-1], nil
+}
+
+// FetchBundle returns the tarball stored in the named bundle secret.
+func FetchBundle(kubeClient kubernetes.Interface, namespace, name string) ([]byte, error) {
+	secret, err := kubeClient.Core().Secrets(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	tgz, ok := secret.Data[bundleKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s is not a migration bundle", name)
+	}
+	return tgz, nil
+}
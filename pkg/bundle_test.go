@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+// untar returns the files of a gzipped tarball keyed by name.
+func untar(t *testing.T, tgz []byte) map[string]string {
+	gz, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: BundlePrefix + "20170101-000000", Labels: map[string]string{bundleLabel: "true"}},
+		Data:       map[string][]byte{bundleKey: []byte("old")},
+	})
+
+	b := NewBundle(clientset, "deis", "deis-workflow")
+	b.Add("values.yaml", []byte("global:\n  storage: minio\n"))
+	b.AddManifest(`
+---
+# Source: workflow/charts/router/templates/router-service.yaml
+kind: Service
+---
+# Source: workflow/charts/router/templates/router-service.yaml
+kind: ServiceAccount
+---
+kind: ConfigMap
+`)
+	rls := testRelease(1)
+	if err := b.AddRelease("deis-workflow.v1", rls, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddBackup("Deployment", "deis-router", map[string]string{"kind": "Deployment"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	b.Add("report.json", []byte("{}"))
+	if err := b.Save(); err != nil {
+		t.Fatalf("saving the bundle again: %v", err)
+	}
+
+	latest, err := LatestBundle(clientset, "deis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != b.Name {
+		t.Errorf("latest bundle = %s, want %s", latest, b.Name)
+	}
+	tgz, err := FetchBundle(clientset, "deis", latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := untar(t, tgz)
+
+	encoded := files[b.Name+"/release/deis-workflow.v1"]
+	decoded, err := decodeRelease(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != rls.Name || decoded.Version != rls.Version || decoded.Manifest != rls.Manifest {
+		t.Errorf("decoded release %s v%d doesn't match the stored one", decoded.Name, decoded.Version)
+	}
+	delete(files, b.Name+"/release/deis-workflow.v1")
+	want := map[string]string{
+		b.Name + "/values.yaml": "global:\n  storage: minio\n",
+		b.Name + "/manifest/workflow/charts/router/templates/router-service.yaml": "# Source: workflow/charts/router/templates/router-service.yaml\nkind: Service\n" +
+			"---\n# Source: workflow/charts/router/templates/router-service.yaml\nkind: ServiceAccount\n",
+		b.Name + "/manifest/unknown.yaml":               "kind: ConfigMap\n",
+		b.Name + "/backups/deployment-deis-router.yaml": "kind: Deployment\n",
+		b.Name + "/report.json":                         "{}",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %q, want %q", files, want)
+	}
+
+	if _, err := FetchBundle(clientset, "deis", "missing"); err == nil {
+		t.Error("expected an error fetching a missing bundle")
+	}
+	empty, clientset2 := newTestServer(t)
+	defer empty.Close()
+	if _, err := LatestBundle(clientset2, "deis"); err == nil {
+		t.Error("expected an error without any bundle")
+	}
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/labels"
+)
+
+// DeletedDeployments are the deployments the migration deletes, since patching them
+// fails on clusters before 1.4.4 (https://github.com/kubernetes/kubernetes/pull/35071).
+// They are left out of the manifest and created again by the upgrade.
+var DeletedDeployments = []string{"deis-controller", "deis-registry"}
+
+// ManifestObject is an object of a release manifest along with the path of the
+// template it is rendered from.
+type ManifestObject struct {
+	Source string
+	Object Object
+}
+
+// CaptureManifest returns the objects of the install in namespace matching
+// selector, which make up the release manifest. The hook secrets are left out. The
+// objects are normalized, so the manifest doesn't carry what the server added to
+// them. Objects of kinds found in apiVersions are recorded with that apiVersion,
+// the others with the version the server serves them in.
+func CaptureManifest(kubeClient kubernetes.Interface, namespace string, selector labels.Selector, hookSecrets []string, apiVersions map[string]string) ([]ManifestObject, error) {
+	var objs []ManifestObject
+	opts := api.ListOptions{LabelSelector: selector}
+	add := func(kind, apiVersion, name, suffix string, v interface{}) error {
+		obj, err := ToObject(v)
+		if err != nil {
+			return err
+		}
+		// the defaults are those of the version the object was read in
+		obj["kind"] = kind
+		obj["apiVersion"] = apiVersion
+		Normalize(obj)
+		if version, ok := apiVersions[kind]; ok {
+			obj["apiVersion"] = version
+		}
+		nameDet := strings.SplitN(name, "-", 2)
+		component := nameDet[len(nameDet)-1]
+		path := "workflow/charts/" + component + "templates/" + component + "-" + suffix + ".yaml"
+		objs = append(objs, ManifestObject{Source: path, Object: obj})
+		return nil
+	}
+
+	serviceAccounts, err := kubeClient.Core().ServiceAccounts(namespace).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, serviceAccount := range serviceAccounts.Items {
+		serviceAccount.Secrets = nil
+		if err := add("ServiceAccount", "v1", serviceAccount.Name, "service-account", serviceAccount); err != nil {
+			return nil, err
+		}
+	}
+
+	secretsMap := make(map[string]struct{})
+	for _, secret := range hookSecrets {
+		secretsMap[secret] = struct{}{}
+	}
+	secrets, err := kubeClient.Core().Secrets(namespace).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, secret := range secrets.Items {
+		if _, ok := secretsMap[secret.Name]; ok {
+			continue
+		}
+		if err := add("Secret", "v1", secret.Name, "secret", secret); err != nil {
+			return nil, err
+		}
+	}
+
+	services, err := kubeClient.Core().Services(namespace).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services.Items {
+		if err := add("Service", "v1", service.Name, "service", service); err != nil {
+			return nil, err
+		}
+	}
+	// deis-logger-redis service has label `heritage: helm` and hence needs to be manually queried.
+	service, err := kubeClient.Core().Services(namespace).Get("deis-logger-redis")
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil && !selector.Matches(labels.Set(service.Labels)) {
+		if err := add("Service", "v1", service.Name, "service", service); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kind := range []string{"Deployment", "DaemonSet"} {
+		r, err := ResolveResource(kubeClient, kind)
+		if err != nil {
+			return nil, err
+		}
+		items, err := ListObjects(kubeClient, r, namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			meta, err := item.ObjectMeta()
+			if err != nil {
+				return nil, err
+			}
+			if err := add(kind, r.APIVersion(), meta.Name, strings.ToLower(kind), item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return objs, nil
+}
+
+// ManifestFromFiles returns the objects of the helm-classic manifests that make up
+// the release manifest, each under the template path of the new chart. The hook
+// secrets are left out, and so is the namespace, which must outlive the release.
+// Objects without a namespace are placed in namespace. Objects of kinds found in
+// apiVersions are recorded with that apiVersion.
+func ManifestFromFiles(files []ManifestFile, namespace string, hookSecrets []string, apiVersions, templatePaths map[string]string) []ManifestObject {
+	secretsMap := make(map[string]struct{})
+	for _, secret := range hookSecrets {
+		secretsMap[secret] = struct{}{}
+	}
+	var objs []ManifestObject
+	for _, file := range files {
+		for _, obj := range file.Objects {
+			ref := obj.Ref(namespace)
+			if ref.Kind == "Namespace" {
+				continue
+			}
+			if _, ok := secretsMap[ref.Name]; ok && ref.Kind == "Secret" {
+				continue
+			}
+			if version, ok := apiVersions[ref.Kind]; ok {
+				obj["apiVersion"] = version
+			}
+			objs = append(objs, ManifestObject{Source: SourcePath(file.Name, obj, templatePaths), Object: obj})
+		}
+	}
+	return objs
+}
+
+// ManifestRefs returns references to the objects, placing those without a
+// namespace in namespace.
+func ManifestRefs(objs []ManifestObject, namespace string) []ObjectRef {
+	refs := make([]ObjectRef, 0, len(objs))
+	for _, obj := range objs {
+		refs = append(refs, obj.Object.Ref(namespace))
+	}
+	return refs
+}
+
+// StampObjects applies stamp to the labels and annotations of every object. Only
+// those are written back, into the metadata map in place, since a round trip
+// through v1.ObjectMeta would bring back fields Normalize removed, like
+// creationTimestamp.
+func StampObjects(objs []ManifestObject, stamp func(kind string, objMeta *v1.ObjectMeta)) error {
+	for _, obj := range objs {
+		objMeta, err := obj.Object.ObjectMeta()
+		if err != nil {
+			return fmt.Errorf("%s: %v", obj.Source, err)
+		}
+		stamp(obj.Object.Kind(), &objMeta)
+		metadata := child(obj.Object, "metadata")
+		if metadata == nil {
+			metadata = make(map[string]interface{})
+			obj.Object["metadata"] = metadata
+		}
+		setStringMap(metadata, "labels", objMeta.Labels)
+		setStringMap(metadata, "annotations", objMeta.Annotations)
+	}
+	return nil
+}
+
+// setStringMap sets key of m to values, or removes it if there are none.
+func setStringMap(m map[string]interface{}, key string, values map[string]string) {
+	if len(values) == 0 {
+		delete(m, key)
+		return
+	}
+	converted := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		converted[k] = v
+	}
+	m[key] = converted
+}
+
+// RenderManifest renders the objects as a release manifest, each document headed
+// by the path of its template like Tiller renders them.
+func RenderManifest(objs []ManifestObject) (string, error) {
+	b := bytes.NewBuffer(nil)
+	for _, obj := range objs {
+		y, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", obj.Source, err)
+		}
+		b.WriteString("\n---\n# Source: " + obj.Source + "\n")
+		b.Write(y)
+	}
+	return b.String(), nil
+}
+
+// DeleteDeployments deletes the DeletedDeployments in namespace. Their replica sets
+// and pods are orphaned, so the components keep running until the upgrade creates
+// the deployments again and adopts them. backup, if set, is given each deployment
+// before it is deleted, and a failing backup stops the deletion. Deployments that
+// don't exist, like the registry with an off-cluster registry, are skipped. It
+// returns the names of the deleted deployments.
+func DeleteDeployments(kubeClient kubernetes.Interface, namespace string, backup func(name string, obj Object) error) ([]string, error) {
+	r, err := ResolveResource(kubeClient, "Deployment")
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for _, deployment := range DeletedDeployments {
+		obj, err := GetObject(kubeClient, r, namespace, deployment)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, err
+		}
+		if backup != nil {
+			if err := backup(deployment, obj); err != nil {
+				return deleted, err
+			}
+		}
+		if err := DeleteObject(kubeClient, r, namespace, deployment, PropagationOrphan); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, deployment)
+	}
+	return deleted, nil
+}
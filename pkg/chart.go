@@ -0,0 +1,231 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// DefaultHookSecrets are the secrets generated by the workflow charts up to v2.7.0.
+// They are used when no target chart is given.
+var DefaultHookSecrets = []string{"builder-key-auth", "builder-ssh-private-keys", "database-creds", "django-secret-key", "logger-redis-creds"}
+
+// randomFuncs are the template functions whose output changes on every render.
+var randomFuncs = []string{"randAlphaNum", "randAlpha", "randNumeric", "randAscii", "genPrivateKey", "genCA", "genSelfSignedCert", "genSignedCert"}
+
+var (
+	docSeparator = regexp.MustCompile(`(?m)^---\s*$`)
+	kindSecret   = regexp.MustCompile(`(?m)^kind:\s*"?Secret"?\s*$`)
+	hookLine     = regexp.MustCompile(`helm\.sh/hook"?:\s*"?([^"\n]*)`)
+	nameLine     = regexp.MustCompile(`^\s+name:\s*"?([^"\s]+)"?\s*$`)
+	kindLine     = regexp.MustCompile(`(?m)^kind:\s*"?([^"\s]+)"?\s*$`)
+	versionLine  = regexp.MustCompile(`(?m)^apiVersion:\s*"?([^"\s]+)"?\s*$`)
+)
+
+// ChartTemplates returns the template files of the chart at chartPath, either a
+// directory or a packaged .tgz, keyed by their path inside the chart. Templates
+// of subcharts are included.
+func ChartTemplates(chartPath string) (map[string]string, error) {
+	files := make(map[string]string)
+	info, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(chartPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := readChartArchive(f, files); err != nil {
+			return nil, err
+		}
+		return files, nil
+	}
+	err = filepath.Walk(chartPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(filepath.Dir(chartPath), p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(rel, ".tgz") {
+			return readChartArchive(bytes.NewReader(data), files)
+		}
+		if isTemplate(rel) {
+			files[rel] = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// readChartArchive adds the templates in a gzipped chart archive to files.
+// Subcharts packaged inside the archive are read as well.
+func readChartArchive(r io.Reader, files map[string]string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if strings.HasSuffix(name, ".tgz") {
+			if err := readChartArchive(bytes.NewReader(data), files); err != nil {
+				return err
+			}
+			continue
+		}
+		if isTemplate(name) {
+			files[name] = string(data)
+		}
+	}
+}
+
+func isTemplate(name string) bool {
+	return path.Base(path.Dir(name)) == "templates" && (strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml"))
+}
+
+// HookSecrets returns the names of the secrets the chart templates mark as
+// pre-install hooks or fill with random values. Those secrets must survive the
+// migration unchanged, so they are annotated as hooks and left out of the manifest.
+func HookSecrets(templates map[string]string) []string {
+	names := make(map[string]struct{})
+	for _, content := range templates {
+		for _, doc := range docSeparator.Split(content, -1) {
+			if !kindSecret.MatchString(doc) {
+				continue
+			}
+			if !isPreInstallHook(doc) && !usesRandom(doc) {
+				continue
+			}
+			if name := metadataName(doc); name != "" {
+				names[name] = struct{}{}
+			}
+		}
+	}
+	secrets := make([]string, 0, len(names))
+	for name := range names {
+		secrets = append(secrets, name)
+	}
+	sort.Strings(secrets)
+	return secrets
+}
+
+func isPreInstallHook(doc string) bool {
+	for _, match := range hookLine.FindAllStringSubmatch(doc, -1) {
+		if strings.Contains(match[1], "pre-install") {
+			return true
+		}
+	}
+	return false
+}
+
+func usesRandom(doc string) bool {
+	for _, fn := range randomFuncs {
+		if strings.Contains(doc, fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataName returns the literal metadata.name of a template document, or an
+// empty string if it isn't found or is computed by the template.
+func metadataName(doc string) string {
+	inMetadata := false
+	indent := ""
+	for _, line := range strings.Split(doc, "\n") {
+		if strings.HasPrefix(line, "metadata:") {
+			inMetadata = true
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if !inMetadata || trimmed == "" || strings.HasPrefix(trimmed, "{{") {
+			continue
+		}
+		if line[0] != ' ' {
+			return ""
+		}
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+		if indent == "" {
+			indent = lineIndent
+		}
+		if lineIndent != indent {
+			continue
+		}
+		if match := nameLine.FindStringSubmatch(line); match != nil {
+			if strings.Contains(match[1], "{{") {
+				return ""
+			}
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// ChartAPIVersions returns the apiVersion the chart templates use for each kind.
+// Versions that are computed by the template are left out. When templates disagree
+// on the version of a kind, the first template in path order wins, and every
+// disagreement is returned as well.
+func ChartAPIVersions(templates map[string]string) (map[string]string, []string) {
+	paths := make([]string, 0, len(templates))
+	for path := range templates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	versions := make(map[string]string)
+	sources := make(map[string]string)
+	var conflicts []string
+	for _, path := range paths {
+		for _, doc := range docSeparator.Split(templates[path], -1) {
+			kind := kindLine.FindStringSubmatch(doc)
+			version := versionLine.FindStringSubmatch(doc)
+			if kind == nil || version == nil || strings.Contains(version[1], "{{") {
+				continue
+			}
+			if previous, ok := versions[kind[1]]; ok {
+				if previous != version[1] {
+					conflicts = append(conflicts, fmt.Sprintf("%s is %s in %s but %s in %s, using %s", kind[1], previous, sources[kind[1]], version[1], path, previous))
+				}
+				continue
+			}
+			versions[kind[1]] = version[1]
+			sources[kind[1]] = path
+		}
+	}
+	return versions, conflicts
+}
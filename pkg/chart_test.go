@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var chartTemplates = map[string]string{
+	"workflow/charts/database/templates/database-secret-creds.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: database-creds
+  labels:
+    heritage: deis
+  annotations:
+    "helm.sh/hook": pre-install
+data:
+  user: {{ randAlphaNum 32 | b64enc }}
+`,
+	"workflow/charts/controller/templates/controller-secret-django-secret-key.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  labels:
+    heritage: deis
+  name: django-secret-key
+data:
+  secret-key: {{ randAscii 64 | b64enc }}
+`,
+	"workflow/charts/builder/templates/builder-secret-ssh-private-keys.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: builder-ssh-private-keys
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+type: Opaque
+`,
+	"workflow/charts/registry/templates/registry-secret.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ .Values.secretName }}
+  annotations:
+    helm.sh/hook: pre-install
+`,
+	"workflow/templates/objectstorage-secret.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: objectstorage-keyfile
+data:
+  accesskey: {{ .Values.accesskey | b64enc }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: dockerbuilder-config
+  annotations:
+    helm.sh/hook: pre-install
+`,
+	"workflow/charts/router/templates/router-deployment.yaml": `apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-router
+`,
+	"workflow/charts/builder/templates/builder-deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deis-builder
+`,
+	"workflow/charts/logger/templates/logger-daemon.yaml": `apiVersion: {{ .Values.daemonSetVersion }}
+kind: DaemonSet
+metadata:
+  name: deis-logger-fluentd
+`,
+}
+
+func TestHookSecrets(t *testing.T) {
+	want := []string{"builder-ssh-private-keys", "database-creds", "django-secret-key"}
+	if got := HookSecrets(chartTemplates); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMetadataName(t *testing.T) {
+	tests := map[string]string{
+		"kind: Secret\nmetadata:\n  name: database-creds\n":                            "database-creds",
+		"kind: Secret\nmetadata:\n  labels:\n    name: other\n  name: \"quoted\"\n":    "quoted",
+		"kind: Secret\nmetadata:\n  name: {{ .Values.name }}\n":                        "",
+		"kind: Secret\nmetadata:\n  labels: {}\nspec:\n  name: outside-metadata\n":     "",
+		"kind: Secret\nmetadata:\n{{ include \"labels\" . }}\n  name: after-include\n": "after-include",
+	}
+	for doc, want := range tests {
+		if got := metadataName(doc); got != want {
+			t.Errorf("metadataName(%q) = %q, want %q", doc, got, want)
+		}
+	}
+}
+
+func TestChartAPIVersions(t *testing.T) {
+	templates := map[string]string{}
+	for path, template := range chartTemplates {
+		templates[path] = template
+	}
+	versions, conflicts := ChartAPIVersions(templates)
+	want := map[string]string{"Secret": "v1", "ConfigMap": "v1", "Deployment": "apps/v1"}
+	if !reflect.DeepEqual(versions, want) {
+		t.Errorf("got versions %v, want %v", versions, want)
+	}
+	wantConflicts := []string{"Deployment is apps/v1 in workflow/charts/builder/templates/builder-deployment.yaml but extensions/v1beta1 in workflow/charts/router/templates/router-deployment.yaml, using apps/v1"}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("got conflicts %q, want %q", conflicts, wantConflicts)
+	}
+}
+
+func TestChartTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workflow-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("workflow/Chart.yaml", "name: workflow\n")
+	write("workflow/templates/objectstorage-secret.yaml", "kind: Secret\n")
+	write("workflow/templates/NOTES.txt", "notes\n")
+	write("workflow/charts/builder/templates/builder-deployment.yml", "kind: Deployment\n")
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	content := []byte("kind: Secret\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "router/templates/router-secret.yaml", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gz.Close()
+	write("workflow/charts/router-v2.7.0.tgz", archive.String())
+
+	files, err := ChartTemplates(filepath.Join(dir, "workflow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"workflow/templates/objectstorage-secret.yaml":             "kind: Secret\n",
+		"workflow/charts/builder/templates/builder-deployment.yml": "kind: Deployment\n",
+		"router/templates/router-secret.yaml":                      "kind: Secret\n",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %v, want %v", files, want)
+	}
+}
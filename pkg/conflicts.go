@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Conflict is a change between two manifests that the API server refuses to apply
+// to an existing object, with what to do about it before the upgrade.
+type Conflict struct {
+	Object ObjectRef
+	Field  string
+	Old    string
+	New    string
+	Action string
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s: %s changes from %s to %s\n  %s", c.Object, c.Field, c.Old, c.New, c.Action)
+}
+
+// FindConflicts compares the manifest of a stored release with the manifest of the
+// chart it is about to be upgraded to, and returns every object whose upgrade would
+// change an immutable field. Objects only found on one side are created or deleted
+// by the upgrade and can't conflict. Objects without a namespace are placed in
+// namespace.
+func FindConflicts(oldManifest, newManifest, namespace string) ([]Conflict, error) {
+	oldObjs, err := parseObjects(oldManifest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the release manifest: %v", err)
+	}
+	newObjs, err := parseObjects(newManifest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the chart manifest: %v", err)
+	}
+	old := make(map[ObjectRef]Object)
+	for _, obj := range oldObjs {
+		old[obj.Ref(namespace)] = obj
+	}
+	var conflicts []Conflict
+	for _, obj := range newObjs {
+		ref := obj.Ref(namespace)
+		previous, ok := old[ref]
+		if !ok {
+			continue
+		}
+		conflicts = append(conflicts, objectConflicts(ref, previous, obj)...)
+	}
+	return conflicts, nil
+}
+
+func objectConflicts(ref ObjectRef, oldObj, newObj Object) []Conflict {
+	var conflicts []Conflict
+	changed := func(field string, a, b interface{}, action string) {
+		if reflect.DeepEqual(a, b) {
+			return
+		}
+		conflicts = append(conflicts, Conflict{Object: ref, Field: field, Old: describe(a), New: describe(b), Action: action})
+	}
+	oldSpec, newSpec := child(oldObj, "spec"), child(newObj, "spec")
+	switch ref.Kind {
+	case "Deployment", "DaemonSet", "StatefulSet":
+		// pods the old selector picked would be left to the old controller, so the
+		// object is deleted without its pods and they are cleaned up after the rollout
+		changed("spec.selector", effectiveSelector(oldSpec), effectiveSelector(newSpec), fmt.Sprintf(
+			"delete it before the upgrade, keeping its pods: kubectl --namespace=%s delete %s %s --cascade=false, then delete the old pods once the new ones are ready",
+			ref.Namespace, strings.ToLower(ref.Kind), ref.Name))
+	case "Service":
+		// the type can be updated in place, only the cluster IP, including turning a
+		// headless service into one with an IP or back, needs a new object
+		recreate := fmt.Sprintf("delete it before the upgrade to have it recreated: kubectl --namespace=%s delete service %s (clients see a new cluster IP)", ref.Namespace, ref.Name)
+		if serviceType(oldSpec) == "LoadBalancer" || serviceType(newSpec) == "LoadBalancer" {
+			recreate += "; WARNING: this releases the load balancer, its external IP or hostname changes and DNS records pointing at it must be updated"
+		}
+		changed("spec.clusterIP", clusterIP(oldSpec), clusterIP(newSpec), recreate)
+	case "PersistentVolumeClaim":
+		changed("spec", oldSpec, newSpec, fmt.Sprintf(
+			"keep the claim as it is: render the chart with its current spec, since deleting it (kubectl --namespace=%s delete pvc %s) deletes its data",
+			ref.Namespace, ref.Name))
+	}
+	return conflicts
+}
+
+// effectiveSelector returns the selector of a controller spec, or the selector the
+// server derives from the pod template labels when the spec doesn't set one.
+func effectiveSelector(spec map[string]interface{}) interface{} {
+	if selector, ok := spec["selector"]; ok {
+		return selector
+	}
+	labels := child(child(child(spec, "template"), "metadata"), "labels")
+	if labels == nil {
+		return nil
+	}
+	return map[string]interface{}{"matchLabels": labels}
+}
+
+// clusterIP returns the cluster IP a service spec asks for: None for a headless
+// service, a fixed address, or nil for one allocated by the server.
+func clusterIP(spec map[string]interface{}) interface{} {
+	if ip, ok := spec["clusterIP"].(string); ok && ip != "" {
+		return ip
+	}
+	return nil
+}
+
+func serviceType(spec map[string]interface{}) interface{} {
+	if t, ok := spec["type"].(string); ok && t != "" {
+		return t
+	}
+	return "ClusterIP"
+}
+
+func describe(v interface{}) string {
+	if v == nil {
+		return "unset"
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+const releaseManifest = `---
+# Source: workflow/charts/router/templates/router-deployment.yaml
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-router
+spec:
+  template:
+    metadata:
+      labels:
+        app: deis-router
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-router
+spec:
+  type: LoadBalancer
+  ports:
+  - port: 80
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-database
+spec:
+  ports:
+  - port: 5432
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: deis-registry
+spec:
+  resources:
+    requests:
+      storage: 10Gi
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: slugbuilder-config
+data:
+  image: quay.io/deis/slugbuilder:v2.4.9
+`
+
+func TestFindConflicts(t *testing.T) {
+	chartManifest := `
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-router
+  namespace: deis
+spec:
+  selector:
+    matchLabels:
+      app: deis-router
+      heritage: deis
+  template:
+    metadata:
+      labels:
+        app: deis-router
+        heritage: deis
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-router
+spec:
+  clusterIP: None
+  type: ClusterIP
+  ports:
+  - port: 80
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-database
+spec:
+  type: NodePort
+  ports:
+  - port: 5432
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: deis-registry
+spec:
+  resources:
+    requests:
+      storage: 20Gi
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: slugbuilder-config
+data:
+  image: quay.io/deis/slugbuilder:v2.5.0
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-monitor-telegraf
+spec:
+  selector:
+    matchLabels:
+      app: deis-monitor-telegraf
+`
+	conflicts, err := FindConflicts(releaseManifest, chartManifest, "deis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		object, field, old, new string
+		warning                 bool
+	}{
+		{"Deployment deis/deis-router", "spec.selector", `{"matchLabels":{"app":"deis-router"}}`, `{"matchLabels":{"app":"deis-router","heritage":"deis"}}`, false},
+		{"Service deis/deis-router", "spec.clusterIP", "unset", `"None"`, true},
+		{"PersistentVolumeClaim deis/deis-registry", "spec", `{"resources":{"requests":{"storage":"10Gi"}}}`, `{"resources":{"requests":{"storage":"20Gi"}}}`, false},
+	}
+	if len(conflicts) != len(want) {
+		t.Fatalf("got %d conflicts, want %d: %v", len(conflicts), len(want), conflicts)
+	}
+	for i, w := range want {
+		c := conflicts[i]
+		if c.Object.String() != w.object || c.Field != w.field || c.Old != w.old || c.New != w.new {
+			t.Errorf("conflict %d: got %s %s %s -> %s, want %s %s %s -> %s", i, c.Object, c.Field, c.Old, c.New, w.object, w.field, w.old, w.new)
+		}
+		if warning := strings.Contains(c.Action, "WARNING"); warning != w.warning {
+			t.Errorf("conflict %d: warning is %t, want %t: %s", i, warning, w.warning, c.Action)
+		}
+	}
+	if !strings.Contains(conflicts[0].Action, "kubectl --namespace=deis delete deployment deis-router --cascade=false") {
+		t.Errorf("unexpected action for the selector change: %s", conflicts[0].Action)
+	}
+}
+
+func TestFindConflictsSameManifest(t *testing.T) {
+	conflicts, err := FindConflicts(releaseManifest, releaseManifest, "deis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("got conflicts between identical manifests: %v", conflicts)
+	}
+}
+
+func TestFindConflictsInvalidManifest(t *testing.T) {
+	if _, err := FindConflicts("kind: [", releaseManifest, "deis"); err == nil {
+		t.Error("expected an error for an invalid release manifest")
+	}
+}
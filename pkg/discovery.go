@@ -0,0 +1,265 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/labels"
+)
+
+// groupCandidates lists, per lowercase kind, the API groups that have served the
+// kind over the Kubernetes releases, newest first. The typed clients only know the
+// oldest of them, so these kinds are always looked up through discovery.
+var groupCandidates = map[string][]string{
+	"deployment":          {"apps", "extensions"},
+	"daemonset":           {"apps", "extensions"},
+	"replicaset":          {"apps", "extensions"},
+	"statefulset":         {"apps"},
+	"ingress":             {"networking.k8s.io", "extensions"},
+	"poddisruptionbudget": {"policy"},
+}
+
+// APIResource is where the server serves a kind.
+type APIResource struct {
+	Group    string
+	Version  string
+	Resource string
+	Kind     string
+}
+
+// APIVersion returns the group/version of the resource as used in manifests.
+func (r APIResource) APIVersion() string {
+	return r.Group + "/" + r.Version
+}
+
+func (r APIResource) path(namespace, name string) []string {
+	segments := []string{"/apis", r.Group, r.Version, "namespaces", namespace, r.Resource}
+	if name != "" {
+		segments = append(segments, name)
+	}
+	return segments
+}
+
+type apiResourceList struct {
+	Resources []struct {
+		Name string `json:"name"`
+		Kind string `json:"kind"`
+	} `json:"resources"`
+}
+
+var discovered = struct {
+	sync.Mutex
+	resources map[kubernetes.Interface]map[string]APIResource
+}{resources: make(map[kubernetes.Interface]map[string]APIResource)}
+
+// ResolveResource returns the group, version and resource the server serves kind
+// under. Groups are tried newest first and, within a group, the version the server
+// prefers first. Lookups are cached per client.
+func ResolveResource(kubeClient kubernetes.Interface, kind string) (APIResource, error) {
+	discovered.Lock()
+	defer discovered.Unlock()
+	key := strings.ToLower(kind)
+	if r, ok := discovered.resources[kubeClient][key]; ok {
+		return r, nil
+	}
+	candidates, ok := groupCandidates[key]
+	if !ok {
+		return APIResource{}, fmt.Errorf("%s is not a kind that needs discovery", kind)
+	}
+	groups, err := kubeClient.Discovery().ServerGroups()
+	if err != nil {
+		return APIResource{}, err
+	}
+	for _, name := range candidates {
+		for _, group := range groups.Groups {
+			if group.Name != name {
+				continue
+			}
+			versions := []string{group.PreferredVersion.Version}
+			for _, v := range group.Versions {
+				if v.Version != group.PreferredVersion.Version {
+					versions = append(versions, v.Version)
+				}
+			}
+			for _, version := range versions {
+				r, found, err := findResource(kubeClient, name, version, kind)
+				if err != nil {
+					return APIResource{}, err
+				}
+				if found {
+					if discovered.resources[kubeClient] == nil {
+						discovered.resources[kubeClient] = make(map[string]APIResource)
+					}
+					discovered.resources[kubeClient][key] = r
+					return r, nil
+				}
+			}
+		}
+	}
+	return APIResource{}, fmt.Errorf("the server doesn't serve %s in any of the API groups %s", kind, strings.Join(candidates, ", "))
+}
+
+func findResource(kubeClient kubernetes.Interface, group, version, kind string) (APIResource, bool, error) {
+	raw, err := kubeClient.Core().GetRESTClient().Get().AbsPath("/apis", group, version).Do().Raw()
+	if err != nil {
+		return APIResource{}, false, err
+	}
+	list := apiResourceList{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return APIResource{}, false, err
+	}
+	for _, resource := range list.Resources {
+		// subresources like deployments/status share the kind of their parent
+		if strings.Contains(resource.Name, "/") || !strings.EqualFold(resource.Kind, kind) {
+			continue
+		}
+		return APIResource{Group: group, Version: version, Resource: resource.Name, Kind: resource.Kind}, true, nil
+	}
+	return APIResource{}, false, nil
+}
+
+// Object is an object read in whatever version the server serves it.
+type Object map[string]interface{}
+
+// Into decodes the object into a typed struct. The fields workflow relies on are
+// the same across the versions of a kind, so any version's struct will do.
+func (o Object) Into(v interface{}) error {
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ObjectMeta returns the metadata of the object.
+func (o Object) ObjectMeta() (v1.ObjectMeta, error) {
+	meta := v1.ObjectMeta{}
+	b, err := json.Marshal(o["metadata"])
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	return meta, err
+}
+
+// SetObjectMeta replaces the metadata of the object.
+func (o Object) SetObjectMeta(meta v1.ObjectMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]interface{})
+	if err := json.Unmarshal(b, &metadata); err != nil {
+		return err
+	}
+	o["metadata"] = metadata
+	return nil
+}
+
+// ListObjects lists the objects of a resource in namespace matching selector.
+func ListObjects(kubeClient kubernetes.Interface, r APIResource, namespace string, selector labels.Selector) ([]Object, error) {
+	req := kubeClient.Core().GetRESTClient().Get().AbsPath(r.path(namespace, "")...)
+	if selector != nil && !selector.Empty() {
+		req = req.Param("labelSelector", selector.String())
+	}
+	raw, err := req.Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	list := struct {
+		Items []Object `json:"items"`
+	}{}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	// items of a list don't carry their kind
+	for _, item := range list.Items {
+		item["kind"] = r.Kind
+		item["apiVersion"] = r.APIVersion()
+	}
+	return list.Items, nil
+}
+
+// listObjects resolves kind and lists all of its objects in namespace.
+func listObjects(kubeClient kubernetes.Interface, kind, namespace string) ([]Object, error) {
+	r, err := ResolveResource(kubeClient, kind)
+	if err != nil {
+		return nil, err
+	}
+	return ListObjects(kubeClient, r, namespace, nil)
+}
+
+// getObject resolves kind and returns the named object decoded into v.
+func getObject(kubeClient kubernetes.Interface, kind, namespace, name string, v interface{}) error {
+	r, err := ResolveResource(kubeClient, kind)
+	if err != nil {
+		return err
+	}
+	obj, err := GetObject(kubeClient, r, namespace, name)
+	if err != nil {
+		return err
+	}
+	return obj.Into(v)
+}
+
+// GetObject returns the named object of a resource.
+func GetObject(kubeClient kubernetes.Interface, r APIResource, namespace, name string) (Object, error) {
+	raw, err := kubeClient.Core().GetRESTClient().Get().AbsPath(r.path(namespace, name)...).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	obj := Object{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// CreateObject creates an object of a resource.
+func CreateObject(kubeClient kubernetes.Interface, r APIResource, namespace string, obj Object) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	return kubeClient.Core().GetRESTClient().Post().
+		AbsPath(r.path(namespace, "")...).
+		Body(body).
+		Do().
+		Error()
+}
+
+// PatchResource applies a JSON merge patch to the named object of a resource.
+func PatchResource(kubeClient kubernetes.Interface, r APIResource, namespace, name string, patch []byte) error {
+	return kubeClient.Core().GetRESTClient().Patch(api.MergePatchType).
+		AbsPath(r.path(namespace, name)...).
+		Body(patch).
+		Do().
+		Error()
+}
+
+// Propagation policies for DeleteObject.
+const (
+	PropagationOrphan     = "Orphan"
+	PropagationBackground = "Background"
+)
+
+// DeleteObject deletes the named object of a resource, with the given propagation
+// policy for its dependents. The default differs between API groups, e.g.
+// extensions/v1beta1 deployments orphan their replica sets while apps/v1 ones
+// delete them, so the policy is always sent.
+func DeleteObject(kubeClient kubernetes.Interface, r APIResource, namespace, name, propagation string) error {
+	body, err := json.Marshal(map[string]string{"kind": "DeleteOptions", "apiVersion": "v1", "propagationPolicy": propagation})
+	if err != nil {
+		return err
+	}
+	return kubeClient.Core().GetRESTClient().Delete().
+		AbsPath(r.path(namespace, name)...).
+		Body(body).
+		Do().
+		Error()
+}
@@ -0,0 +1,130 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/1.5/rest"
+)
+
+// The channels of the channel.k8s.io websocket protocol the API server speaks for exec.
+const (
+	execProtocol      = "channel.k8s.io"
+	execStdoutChannel = 1
+	execStderrChannel = 2
+	execErrorChannel  = 3
+)
+
+// ExecInPod runs command in the first container of the pod and returns what it
+// wrote to stdout. The command failing, or exiting non-zero, is an error that
+// includes its stderr.
+func ExecInPod(config *rest.Config, namespace, pod string, command []string) (string, error) {
+	u, err := url.Parse(config.Host)
+	if err != nil {
+		return "", err
+	}
+	// a host without a scheme is parsed as a path
+	if u.Host == "" {
+		u, err = url.Parse("https://" + config.Host)
+		if err != nil {
+			return "", err
+		}
+	}
+	if u.Scheme == "http" {
+		u.Scheme = "ws"
+	} else {
+		u.Scheme = "wss"
+	}
+	u.Path = path.Join(u.Path, "/api/v1/namespaces", namespace, "pods", pod, "exec")
+	query := url.Values{}
+	for _, arg := range command {
+		query.Add("command", arg)
+	}
+	query.Set("stdout", "true")
+	query.Set("stderr", "true")
+	u.RawQuery = query.Encode()
+
+	dialer, header, err := execDialer(config)
+	if err != nil {
+		return "", err
+	}
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return "", fmt.Errorf("exec in pod %s: %v (status %d)", pod, err, resp.StatusCode)
+		}
+		return "", fmt.Errorf("exec in pod %s: %v", pod, err)
+	}
+	defer conn.Close()
+
+	var stdout, stderr, execErr bytes.Buffer
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			// the server closes the connection once the command exits
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) || err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return "", fmt.Errorf("exec in pod %s: %v", pod, err)
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case execStdoutChannel:
+			stdout.Write(msg[1:])
+		case execStderrChannel:
+			stderr.Write(msg[1:])
+		case execErrorChannel:
+			execErr.Write(msg[1:])
+		}
+	}
+	if execErr.Len() > 0 {
+		return stdout.String(), fmt.Errorf("%s in pod %s: %s: %s", strings.Join(command, " "), pod, strings.TrimSpace(execErr.String()), strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// execDialer returns a websocket dialer and the request headers that authenticate
+// to the API server the way the clients built from config do: the CA and client
+// certificate from their files or data, or no verification with Insecure, and a
+// bearer token, basic auth or impersonation header. Auth providers and credential
+// plugins hook into the HTTP transport, which a websocket dial doesn't go through,
+// so configs relying on them are refused rather than sent unauthenticated.
+func execDialer(config *rest.Config) (*websocket.Dialer, http.Header, error) {
+	if config.AuthProvider != nil {
+		return nil, nil, fmt.Errorf("exec doesn't support the %s auth provider, use a kubeconfig with a token or client certificate", config.AuthProvider.Name)
+	}
+	if config.WrapTransport != nil {
+		return nil, nil, fmt.Errorf("exec doesn't support credential plugins, use a kubeconfig with a token or client certificate")
+	}
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := http.Header{}
+	if config.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+config.BearerToken)
+	} else if config.Username != "" {
+		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password)))
+	}
+	if config.Impersonate != "" {
+		header.Set("Impersonate-User", config.Impersonate)
+	}
+	if config.UserAgent != "" {
+		header.Set("User-Agent", config.UserAgent)
+	}
+	return &websocket.Dialer{
+		TLSClientConfig:  tlsConfig,
+		Subprotocols:     []string{execProtocol},
+		HandshakeTimeout: 30 * time.Second,
+	}, header, nil
+}
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/client-go/1.5/rest"
+	clientcmdapi "k8s.io/client-go/1.5/tools/clientcmd/api"
+)
+
+// execServer answers exec requests like the API server: it checks the bearer
+// token, then writes the given messages on the channels and closes.
+func execServer(t *testing.T, token string, messages [][]byte) *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{execProtocol}}
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/deis/pods/deis-database-1/exec" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.URL.Query()["command"]; !reflect.DeepEqual(got, []string{"gosu", "postgres", "do_backup"}) {
+			t.Errorf("got command %v", got)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for _, msg := range messages {
+			conn.WriteMessage(websocket.BinaryMessage, msg)
+		}
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	}))
+}
+
+// serverCA returns the PEM encoded certificate of a TLS test server.
+func serverCA(server *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.TLS.Certificates[0].Certificate[0]})
+}
+
+func TestExecInPod(t *testing.T) {
+	server := execServer(t, "secret", [][]byte{
+		append([]byte{execStdoutChannel}, "wal_e.worker.upload "...),
+		append([]byte{execStderrChannel}, "starting"...),
+		append([]byte{execStdoutChannel}, "done\n"...),
+	})
+	defer server.Close()
+	config := &rest.Config{Host: server.URL, BearerToken: "secret"}
+	config.CAData = serverCA(server)
+
+	out, err := ExecInPod(config, "deis", "deis-database-1", []string{"gosu", "postgres", "do_backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "wal_e.worker.upload done\n" {
+		t.Errorf("got stdout %q", out)
+	}
+
+	// without the CA the server's certificate isn't trusted
+	if _, err := ExecInPod(&rest.Config{Host: server.URL, BearerToken: "secret"}, "deis", "deis-database-1", []string{"true"}); err == nil {
+		t.Error("exec succeeded against an untrusted server")
+	}
+	// unless verification is turned off
+	insecure := &rest.Config{Host: server.URL, BearerToken: "secret", Insecure: true}
+	if _, err := ExecInPod(insecure, "deis", "deis-database-1", []string{"gosu", "postgres", "do_backup"}); err != nil {
+		t.Errorf("exec with Insecure failed: %v", err)
+	}
+	insecure.BearerToken = "wrong"
+	if _, err := ExecInPod(insecure, "deis", "deis-database-1", []string{"true"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("got %v with a wrong token", err)
+	}
+}
+
+func TestExecInPodFailure(t *testing.T) {
+	server := execServer(t, "secret", [][]byte{
+		append([]byte{execStderrChannel}, "backup failed"...),
+		append([]byte{execErrorChannel}, "command terminated with non-zero exit code"...),
+	})
+	defer server.Close()
+	config := &rest.Config{Host: server.URL, BearerToken: "secret", Insecure: true}
+	_, err := ExecInPod(config, "deis", "deis-database-1", []string{"gosu", "postgres", "do_backup"})
+	if err == nil || err.Error() != "gosu postgres do_backup in pod deis-database-1: command terminated with non-zero exit code: backup failed" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestExecDialer(t *testing.T) {
+	_, header, err := execDialer(&rest.Config{Username: "admin", Password: "pass", Impersonate: "system:serviceaccount:deis:deis-migration"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := header.Get("Authorization"); got != "Basic YWRtaW46cGFzcw==" {
+		t.Errorf("got Authorization %q", got)
+	}
+	if got := header.Get("Impersonate-User"); got != "system:serviceaccount:deis:deis-migration" {
+		t.Errorf("got Impersonate-User %q", got)
+	}
+
+	if _, _, err := execDialer(&rest.Config{AuthProvider: &clientcmdapi.AuthProviderConfig{Name: "gcp"}}); err == nil || !strings.Contains(err.Error(), "gcp") {
+		t.Errorf("got %v with an auth provider", err)
+	}
+	wrapped := &rest.Config{WrapTransport: func(rt http.RoundTripper) http.RoundTripper { return rt }}
+	if _, _, err := execDialer(wrapped); err == nil {
+		t.Error("accepted a config with a credential plugin")
+	}
+	if _, _, err := execDialer(&rest.Config{Insecure: true, TLSClientConfig: rest.TLSClientConfig{CAData: []byte("ca")}}); err == nil {
+		t.Error("accepted a CA along with Insecure")
+	}
+	if _, _, err := execDialer(&rest.Config{TLSClientConfig: rest.TLSClientConfig{CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"}}); err == nil {
+		t.Error("accepted a client certificate that can't be read")
+	}
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.5/pkg/labels"
+)
+
+const crashLoopBackOff = "CrashLoopBackOff"
+
+// UnhealthyComponents returns a description of every deployment, daemonset and
+// replication controller in the namespace that doesn't have its desired replicas
+// ready, and of every pod with a container in CrashLoopBackOff.
+func UnhealthyComponents(kubeClient kubernetes.Interface, namespace string) ([]string, error) {
+	var unhealthy []string
+	pods, err := kubeClient.Core().Pods(namespace).List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Waiting != nil && status.State.Waiting.Reason == crashLoopBackOff {
+				unhealthy = append(unhealthy, fmt.Sprintf("pod %s: container %s in %s (%d restarts)", pod.Name, status.Name, crashLoopBackOff, status.RestartCount))
+			}
+		}
+	}
+
+	deployments, err := listObjects(kubeClient, "Deployment", namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range deployments {
+		deployment := &v1beta1.Deployment{}
+		if err := obj.Into(deployment); err != nil {
+			return nil, err
+		}
+		if problem := deploymentHealth(deployment); problem != "" {
+			unhealthy = append(unhealthy, problem)
+		}
+	}
+
+	daemonsets, err := listObjects(kubeClient, "DaemonSet", namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range daemonsets {
+		daemonset := &v1beta1.DaemonSet{}
+		if err := obj.Into(daemonset); err != nil {
+			return nil, err
+		}
+		if problem := daemonSetHealth(daemonset, pods.Items); problem != "" {
+			unhealthy = append(unhealthy, problem)
+		}
+	}
+
+	rcs, err := kubeClient.Core().ReplicationControllers(namespace).List(api.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, rc := range rcs.Items {
+		if problem := replicationControllerHealth(&rc, pods.Items); problem != "" {
+			unhealthy = append(unhealthy, problem)
+		}
+	}
+	return unhealthy, nil
+}
+
+// deploymentHealth describes why the deployment isn't ready, or returns "" if it is.
+func deploymentHealth(deployment *v1beta1.Deployment) string {
+	desired := int32(1)
+	if deployment.Spec.Replicas != nil {
+		desired = *deployment.Spec.Replicas
+	}
+	if deployment.Status.AvailableReplicas < desired || deployment.Status.UpdatedReplicas < desired {
+		return fmt.Sprintf("deployment %s: %d/%d available, %d/%d updated", deployment.Name, deployment.Status.AvailableReplicas, desired, deployment.Status.UpdatedReplicas, desired)
+	}
+	return ""
+}
+
+// daemonSetHealth describes why the daemonset isn't ready, or returns "" if it is.
+func daemonSetHealth(daemonset *v1beta1.DaemonSet, pods []v1.Pod) string {
+	desired := daemonset.Status.DesiredNumberScheduled
+	ready := readyPods(pods, daemonset.Spec.Template.Labels)
+	if ready < desired {
+		return fmt.Sprintf("daemonset %s: %d/%d ready", daemonset.Name, ready, desired)
+	}
+	return ""
+}
+
+// replicationControllerHealth describes why the replication controller isn't ready,
+// or returns "" if it is.
+func replicationControllerHealth(rc *v1.ReplicationController, pods []v1.Pod) string {
+	desired := int32(1)
+	if rc.Spec.Replicas != nil {
+		desired = *rc.Spec.Replicas
+	}
+	ready := readyPods(pods, rc.Spec.Selector)
+	if ready < desired {
+		return fmt.Sprintf("replicationcontroller %s: %d/%d ready", rc.Name, ready, desired)
+	}
+	return ""
+}
+
+// WaitForHealthy waits until UnhealthyComponents comes back empty. It returns an
+// error listing the failing components if that doesn't happen within timeout.
+func WaitForHealthy(kubeClient kubernetes.Interface, namespace string, timeout, interval time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		unhealthy, err := UnhealthyComponents(kubeClient, namespace)
+		if err != nil {
+			return err
+		}
+		if len(unhealthy) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("workflow is not healthy after %s:\n  %s", timeout, strings.Join(unhealthy, "\n  "))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// readyPods counts the running pods matching selector that pass their readiness checks.
+func readyPods(pods []v1.Pod, selector map[string]string) int32 {
+	if len(selector) == 0 {
+		return 0
+	}
+	sel := labels.SelectorFromSet(labels.Set(selector))
+	var ready int32
+	for _, pod := range pods {
+		if !sel.Matches(labels.Set(pod.Labels)) || pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				ready++
+				break
+			}
+		}
+	}
+	return ready
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+)
+
+func readyPod(name string, labels map[string]string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Labels: labels},
+		Status: v1.PodStatus{
+			Phase:      v1.PodRunning,
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}},
+		},
+	}
+}
+
+func TestUnhealthyComponents(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.discover("extensions/v1beta1", "Deployment", "DaemonSet")
+	one, two := int32(1), int32(2)
+
+	s.add(t, "/api/v1/namespaces/deis/pods", readyPod("deis-logger-fluentd-1", map[string]string{"app": "deis-logger-fluentd"}))
+	s.add(t, "/api/v1/namespaces/deis/pods", readyPod("deis-registry-proxy-1", map[string]string{"app": "deis-registry-proxy"}))
+	s.add(t, "/api/v1/namespaces/deis/pods", readyPod("deis-database-1", map[string]string{"app": "deis-database"}))
+	s.add(t, "/api/v1/namespaces/deis/pods", &v1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-controller-1", Labels: map[string]string{"app": "deis-controller"}},
+		Status: v1.PodStatus{
+			Phase: v1.PodRunning,
+			ContainerStatuses: []v1.ContainerStatus{{
+				Name:         "deis-controller",
+				RestartCount: 7,
+				State:        v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: crashLoopBackOff}},
+			}},
+		},
+	})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-router"},
+		Spec:       v1beta1.DeploymentSpec{Replicas: &one},
+		Status:     v1beta1.DeploymentStatus{AvailableReplicas: 1, UpdatedReplicas: 1},
+	})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-controller"},
+		Spec:       v1beta1.DeploymentSpec{Replicas: &one},
+		Status:     v1beta1.DeploymentStatus{UpdatedReplicas: 1},
+	})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/daemonsets", &v1beta1.DaemonSet{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-logger-fluentd"},
+		Spec:       v1beta1.DaemonSetSpec{Template: v1.PodTemplateSpec{ObjectMeta: v1.ObjectMeta{Labels: map[string]string{"app": "deis-logger-fluentd"}}}},
+		Status:     v1beta1.DaemonSetStatus{DesiredNumberScheduled: 1},
+	})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/daemonsets", &v1beta1.DaemonSet{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-registry-proxy"},
+		Spec:       v1beta1.DaemonSetSpec{Template: v1.PodTemplateSpec{ObjectMeta: v1.ObjectMeta{Labels: map[string]string{"app": "deis-registry-proxy"}}}},
+		Status:     v1beta1.DaemonSetStatus{DesiredNumberScheduled: 2},
+	})
+	s.add(t, "/api/v1/namespaces/deis/replicationcontrollers", &v1.ReplicationController{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-database"},
+		Spec:       v1.ReplicationControllerSpec{Replicas: &one, Selector: map[string]string{"app": "deis-database"}},
+	})
+	s.add(t, "/api/v1/namespaces/deis/replicationcontrollers", &v1.ReplicationController{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-minio"},
+		Spec:       v1.ReplicationControllerSpec{Replicas: &two, Selector: map[string]string{"app": "deis-minio"}},
+	})
+
+	unhealthy, err := UnhealthyComponents(clientset, "deis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"pod deis-controller-1: container deis-controller in CrashLoopBackOff (7 restarts)",
+		"deployment deis-controller: 0/1 available, 1/1 updated",
+		"daemonset deis-registry-proxy: 1/2 ready",
+		"replicationcontroller deis-minio: 0/2 ready",
+	}
+	if !reflect.DeepEqual(unhealthy, want) {
+		t.Errorf("got %q, want %q", unhealthy, want)
+	}
+
+	if err := WaitForHealthy(clientset, "deis", 0, time.Millisecond); err == nil {
+		t.Error("expected WaitForHealthy to time out")
+	}
+}
@@ -7,23 +7,55 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
-	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
 	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
 	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.5/pkg/labels"
 	rspb "k8s.io/helm/pkg/proto/hapi/release"
 )
 
-const tillerNamespace = "kube-system"
+const (
+	// DefaultTillerNamespace is the namespace Tiller is installed in by default.
+	DefaultTillerNamespace = "kube-system"
+
+	tillerDeployment = "tiller-deploy"
+	tillerOwner      = "TILLER"
+
+	// StorageConfigMap and StorageSecret are the storage drivers Tiller supports
+	// through its --storage flag.
+	StorageConfigMap = "configmap"
+	StorageSecret    = "secret"
+)
 
 var b64 = base64.StdEncoding
 
+var magicGzip = []byte{0x1f, 0x8b, 0x08}
+
+// Revision describes a stored revision of a release.
+type Revision struct {
+	Key     string
+	Version int32
+	Status  string
+}
+
+type byVersion []Revision
+
+func (r byVersion) Len() int           { return len(r) }
+func (r byVersion) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byVersion) Less(i, j int) bool { return r[i].Version < r[j].Version }
+
 // CfgCreate creates a configmap based on the release object
-func CfgCreate(key string, rls *rspb.Release, clientset *kubernetes.Clientset) error {
+func CfgCreate(key string, rls *rspb.Release, namespace string, clientset kubernetes.Interface) error {
 	// set labels for configmaps object meta data
 	lbs := make(map[string]string)
 
@@ -35,9 +67,9 @@ func CfgCreate(key string, rls *rspb.Release, clientset *kubernetes.Clientset) e
 		return err
 	}
 	// push the configmap object out into the kubiverse
-	if _, err := clientset.ConfigMaps(tillerNamespace).Create(obj); err != nil {
+	if _, err := clientset.Core().ConfigMaps(namespace).Create(obj); err != nil {
 		if apierrors.IsAlreadyExists(err) {
-			return errors.New("already exists")
+			return fmt.Errorf("release %s already exists", key)
 		}
 
 		return err
@@ -46,8 +78,6 @@ func CfgCreate(key string, rls *rspb.Release, clientset *kubernetes.Clientset) e
 }
 
 func newConfigMapsObject(key string, rls *rspb.Release, lbs map[string]string) (*v1.ConfigMap, error) {
-	const owner = "TILLER"
-
 	// encode the release
 	s, err := encodeRelease(rls)
 	if err != nil {
@@ -55,10 +85,7 @@ func newConfigMapsObject(key string, rls *rspb.Release, lbs map[string]string) (
 	}
 
 	// apply labels
-	lbs["NAME"] = rls.Name
-	lbs["OWNER"] = owner
-	lbs["STATUS"] = rspb.Status_Code_name[int32(rls.Info.Status.Code)]
-	lbs["VERSION"] = strconv.Itoa(int(rls.Version))
+	applyTillerLabels(rls, lbs)
 
 	// create and return configmap object
 	return &v1.ConfigMap{
@@ -70,6 +97,190 @@ func newConfigMapsObject(key string, rls *rspb.Release, lbs map[string]string) (
 	}, nil
 }
 
+// SecretCreate creates a secret based on the release object, the way Tiller's
+// secret storage driver does.
+func SecretCreate(key string, rls *rspb.Release, namespace string, clientset kubernetes.Interface) error {
+	// set labels for secrets object meta data
+	lbs := make(map[string]string)
+
+	lbs["CREATED_AT"] = strconv.Itoa(int(time.Now().Unix()))
+
+	// create a new secret to hold the release
+	obj, err := newSecretsObject(key, rls, lbs)
+	if err != nil {
+		return err
+	}
+	// push the secret object out into the kubiverse
+	if _, err := clientset.Core().Secrets(namespace).Create(obj); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("release %s already exists", key)
+		}
+
+		return err
+	}
+	return nil
+}
+
+func newSecretsObject(key string, rls *rspb.Release, lbs map[string]string) (*v1.Secret, error) {
+	// encode the release
+	s, err := encodeRelease(rls)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply labels
+	applyTillerLabels(rls, lbs)
+
+	// create and return secret object
+	return &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:   key,
+			Labels: lbs,
+		},
+		Data: map[string][]byte{"release": []byte(s)},
+	}, nil
+}
+
+// TillerCreate stores the release using the given Tiller storage driver.
+func TillerCreate(storage, key string, rls *rspb.Release, namespace string, clientset kubernetes.Interface) error {
+	switch storage {
+	case StorageConfigMap:
+		return CfgCreate(key, rls, namespace, clientset)
+	case StorageSecret:
+		return SecretCreate(key, rls, namespace, clientset)
+	}
+	return fmt.Errorf("unknown tiller storage driver %q", storage)
+}
+
+// DetectTillerStorage returns the storage driver the tiller-deploy deployment is
+// started with. Tiller defaults to configmaps when no --storage flag is given.
+func DetectTillerStorage(clientset kubernetes.Interface, namespace string) (string, error) {
+	deployment := &v1beta1.Deployment{}
+	err := getObject(clientset, "Deployment", namespace, tillerDeployment, deployment)
+	if err != nil {
+		return "", err
+	}
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		args := append([]string{}, container.Command...)
+		args = append(args, container.Args...)
+		for i, arg := range args {
+			if strings.HasPrefix(arg, "--storage=") {
+				return strings.TrimPrefix(arg, "--storage="), nil
+			}
+			if arg == "--storage" && i+1 < len(args) {
+				return args[i+1], nil
+			}
+		}
+	}
+	return StorageConfigMap, nil
+}
+
+// DetectTillerVersion returns the version of Tiller, as the tag of the image the
+// tiller-deploy deployment runs.
+func DetectTillerVersion(clientset kubernetes.Interface, namespace string) (string, error) {
+	deployment := &v1beta1.Deployment{}
+	err := getObject(clientset, "Deployment", namespace, tillerDeployment, deployment)
+	if err != nil {
+		return "", err
+	}
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		image := container.Image[strings.LastIndex(container.Image, "/")+1:]
+		if i := strings.LastIndex(image, ":"); i >= 0 {
+			return image[i+1:], nil
+		}
+	}
+	return "", fmt.Errorf("no tagged image in %s", tillerDeployment)
+}
+
+// TillerRevisions returns the revisions of the named release kept by the given
+// Tiller storage driver, oldest first.
+func TillerRevisions(storage, name, namespace string, clientset kubernetes.Interface) ([]Revision, error) {
+	opts := api.ListOptions{LabelSelector: labels.Set{"NAME": name, "OWNER": tillerOwner}.AsSelector()}
+	var revs []Revision
+	switch storage {
+	case StorageConfigMap:
+		list, err := clientset.Core().ConfigMaps(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			revs = append(revs, newRevision(item.Name, item.Labels["VERSION"], item.Labels["STATUS"]))
+		}
+	case StorageSecret:
+		list, err := clientset.Core().Secrets(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			revs = append(revs, newRevision(item.Name, item.Labels["VERSION"], item.Labels["STATUS"]))
+		}
+	default:
+		return nil, fmt.Errorf("unknown tiller storage driver %q", storage)
+	}
+	sort.Sort(byVersion(revs))
+	return revs, nil
+}
+
+// TillerSupersede marks a stored revision as SUPERSEDED, both in its labels and in
+// the encoded release, like Tiller does when a release is upgraded.
+func TillerSupersede(storage string, rev Revision, namespace string, clientset kubernetes.Interface) error {
+	switch storage {
+	case StorageConfigMap:
+		cfg, err := clientset.Core().ConfigMaps(namespace).Get(rev.Key)
+		if err != nil {
+			return err
+		}
+		s, err := supersedeRelease(cfg.Data["release"])
+		if err != nil {
+			return err
+		}
+		cfg.Data["release"] = s
+		markSuperseded(cfg.Labels)
+		_, err = clientset.Core().ConfigMaps(namespace).Update(cfg)
+		return err
+	case StorageSecret:
+		secret, err := clientset.Core().Secrets(namespace).Get(rev.Key)
+		if err != nil {
+			return err
+		}
+		s, err := supersedeRelease(string(secret.Data["release"]))
+		if err != nil {
+			return err
+		}
+		secret.Data["release"] = []byte(s)
+		markSuperseded(secret.Labels)
+		_, err = clientset.Core().Secrets(namespace).Update(secret)
+		return err
+	}
+	return fmt.Errorf("unknown tiller storage driver %q", storage)
+}
+
+func supersedeRelease(data string) (string, error) {
+	rls, err := decodeRelease(data)
+	if err != nil {
+		return "", err
+	}
+	rls.Info.Status.Code = rspb.Status_SUPERSEDED
+	return encodeRelease(rls)
+}
+
+func markSuperseded(lbs map[string]string) {
+	lbs["STATUS"] = rspb.Status_Code_name[int32(rspb.Status_SUPERSEDED)]
+	lbs["MODIFIED_AT"] = strconv.Itoa(int(time.Now().Unix()))
+}
+
+func newRevision(key, version, status string) Revision {
+	v, _ := strconv.Atoi(version)
+	return Revision{Key: key, Version: int32(v), Status: status}
+}
+
+func applyTillerLabels(rls *rspb.Release, lbs map[string]string) {
+	lbs["NAME"] = rls.Name
+	lbs["OWNER"] = tillerOwner
+	lbs["STATUS"] = rspb.Status_Code_name[int32(rls.Info.Status.Code)]
+	lbs["VERSION"] = strconv.Itoa(int(rls.Version))
+}
+
 // encodeRelease encodes a release returning a base64 encoded
 // binary protobuf encoding representation, or error.
 func encodeRelease(rls *rspb.Release) (string, error) {
@@ -88,3 +299,37 @@ func encodeRelease(rls *rspb.Release) (string, error) {
 	w.Close()
 	return b64.EncodeToString(buf.Bytes()), nil
 }
+
+// decodeRelease decodes the bytes in data into a release
+// type. Data must contain a base64 encoded string of a
+// valid protobuf encoding of a release, otherwise
+// an error is returned.
+func decodeRelease(data string) (*rspb.Release, error) {
+	// base64 decode string
+	b, err := b64.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// For backwards compatibility with releases that were stored before
+	// compression was introduced we skip decompression if the
+	// gzip magic header is not found
+	if len(b) > 3 && bytes.Equal(b[0:3], magicGzip) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		b2, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		b = b2
+	}
+
+	var rls rspb.Release
+	// unmarshal protobuf bytes
+	if err := proto.Unmarshal(b, &rls); err != nil {
+		return nil, err
+	}
+	return &rls, nil
+}
@@ -0,0 +1,323 @@
+package pkg
+
+// The release layout and encoding in here mirror the Helm 3 secrets storage driver
+// (https://github.com/helm/helm/tree/main/pkg/storage/driver) so that a Helm 3 client
+// can read the release without Tiller being involved.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/labels"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/timeconv"
+)
+
+const (
+	helm3Owner       = "helm"
+	helm3SecretType  = "helm.sh/release.v1"
+	helm3ChartAPIVer = "v1"
+
+	// Helm3ManagedByLabel, Helm3ReleaseNameAnnotation and Helm3ReleaseNamespaceAnnotation
+	// are checked by Helm 3 before it takes ownership of an existing object.
+	Helm3ManagedByLabel             = "app.kubernetes.io/managed-by"
+	Helm3ReleaseNameAnnotation      = "meta.helm.sh/release-name"
+	Helm3ReleaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+)
+
+// ObjectRef identifies a single namespaced object in the cluster.
+type ObjectRef struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (o ObjectRef) String() string {
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+type helm3Release struct {
+	Name      string                 `json:"name,omitempty"`
+	Info      *helm3Info             `json:"info,omitempty"`
+	Chart     *helm3Chart            `json:"chart,omitempty"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Manifest  string                 `json:"manifest,omitempty"`
+	Version   int                    `json:"version,omitempty"`
+	Namespace string                 `json:"namespace,omitempty"`
+}
+
+type helm3Info struct {
+	FirstDeployed time.Time `json:"first_deployed,omitempty"`
+	LastDeployed  time.Time `json:"last_deployed,omitempty"`
+	Deleted       time.Time `json:"deleted"`
+	Description   string    `json:"description,omitempty"`
+	Status        string    `json:"status,omitempty"`
+}
+
+type helm3Chart struct {
+	Metadata  *helm3Metadata         `json:"metadata"`
+	Templates []interface{}          `json:"templates"`
+	Values    map[string]interface{} `json:"values"`
+	Files     []interface{}          `json:"files"`
+}
+
+type helm3Metadata struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	APIVersion string `json:"apiVersion"`
+}
+
+// Helm3SecretName returns the name of the secret Helm 3 uses for a release revision.
+func Helm3SecretName(name string, version int32) string {
+	return fmt.Sprintf("sh.helm.release.v1.%s.v%d", name, version)
+}
+
+// Helm3Create creates the Helm 3 release secret in the release namespace based on the release object
+func Helm3Create(rls *rspb.Release, clientset kubernetes.Interface) error {
+	// set labels for secrets object meta data
+	lbs := make(map[string]string)
+
+	lbs["createdAt"] = strconv.Itoa(int(time.Now().Unix()))
+
+	obj, err := newHelm3SecretsObject(rls, lbs)
+	if err != nil {
+		return err
+	}
+	if _, err := clientset.Core().Secrets(rls.Namespace).Create(obj); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("release secret %s already exists", obj.Name)
+		}
+
+		return err
+	}
+	return nil
+}
+
+func newHelm3SecretsObject(rls *rspb.Release, lbs map[string]string) (*v1.Secret, error) {
+	s, err := encodeHelm3Release(rls)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply labels
+	lbs["name"] = rls.Name
+	lbs["owner"] = helm3Owner
+	lbs["status"] = helm3Status(rls.Info.Status.Code)
+	lbs["version"] = strconv.Itoa(int(rls.Version))
+
+	return &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      Helm3SecretName(rls.Name, rls.Version),
+			Namespace: rls.Namespace,
+			Labels:    lbs,
+		},
+		Type: helm3SecretType,
+		Data: map[string][]byte{"release": []byte(s)},
+	}, nil
+}
+
+// helm3Status maps the Tiller status codes onto the lower-case names Helm 3 uses.
+func helm3Status(code rspb.Status_Code) string {
+	switch code {
+	case rspb.Status_DEPLOYED:
+		return "deployed"
+	case rspb.Status_SUPERSEDED:
+		return "superseded"
+	case rspb.Status_DELETED:
+		return "uninstalled"
+	case rspb.Status_FAILED:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// encodeHelm3Release converts the Tiller release into the Helm 3 layout and returns
+// its base64 encoded, gzipped JSON representation.
+func encodeHelm3Release(rls *rspb.Release) (string, error) {
+	values := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(rls.Config.Raw), &values); err != nil {
+		return "", err
+	}
+	rel := &helm3Release{
+		Name: rls.Name,
+		Info: &helm3Info{
+			FirstDeployed: timeconv.Time(rls.Info.FirstDeployed),
+			LastDeployed:  timeconv.Time(rls.Info.LastDeployed),
+			Description:   "Migrated from helm-classic",
+			Status:        helm3Status(rls.Info.Status.Code),
+		},
+		Chart: &helm3Chart{
+			Metadata: &helm3Metadata{
+				Name:       rls.Chart.Metadata.Name,
+				Version:    rls.Chart.Metadata.Version,
+				APIVersion: helm3ChartAPIVer,
+			},
+			Values: values,
+		},
+		Config:    values,
+		Manifest:  rls.Manifest,
+		Version:   int(rls.Version),
+		Namespace: rls.Namespace,
+	}
+	return encodeHelm3(rel)
+}
+
+// encodeHelm3 returns the base64 encoded, gzipped JSON representation of rel.
+func encodeHelm3(rel interface{}) (string, error) {
+	b, err := json.Marshal(rel)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(b); err != nil {
+		return "", err
+	}
+	w.Close()
+	return b64.EncodeToString(buf.Bytes()), nil
+}
+
+// decodeHelm3 decodes a Helm 3 release into a generic map so that fields this
+// tool doesn't know about survive a round trip.
+func decodeHelm3(data []byte) (map[string]interface{}, error) {
+	b, err := b64.DecodeString(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 3 && bytes.Equal(b[0:3], magicGzip) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		b, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rel := make(map[string]interface{})
+	if err := json.Unmarshal(b, &rel); err != nil {
+		return nil, err
+	}
+	return rel, nil
+}
+
+// Helm3Revisions returns the revisions of the named release stored in the release
+// namespace, oldest first.
+func Helm3Revisions(name, namespace string, clientset kubernetes.Interface) ([]Revision, error) {
+	opts := api.ListOptions{LabelSelector: labels.Set{"name": name, "owner": helm3Owner}.AsSelector()}
+	list, err := clientset.Core().Secrets(namespace).List(opts)
+	if err != nil {
+		return nil, err
+	}
+	var revs []Revision
+	for _, item := range list.Items {
+		revs = append(revs, newRevision(item.Name, item.Labels["version"], item.Labels["status"]))
+	}
+	sort.Sort(byVersion(revs))
+	return revs, nil
+}
+
+// GetHelm3Release reads a stored Helm 3 release revision. Only the fields it shares
+// with a Tiller release are kept: the name, namespace, version, status, manifest
+// and chart metadata.
+func GetHelm3Release(key, namespace string, clientset kubernetes.Interface) (*rspb.Release, error) {
+	secret, err := clientset.Core().Secrets(namespace).Get(key)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := decodeHelm3(secret.Data["release"])
+	if err != nil {
+		return nil, err
+	}
+	str := func(m map[string]interface{}, key string) string {
+		s, _ := m[key].(string)
+		return s
+	}
+	version, _ := rel["version"].(float64)
+	metadata := child(child(rel, "chart"), "metadata")
+	status := str(child(rel, "info"), "status")
+	code := rspb.Status_UNKNOWN
+	for c := range rspb.Status_Code_name {
+		if s := helm3Status(rspb.Status_Code(c)); s != "unknown" && s == status {
+			code = rspb.Status_Code(c)
+		}
+	}
+	return &rspb.Release{
+		Name:      str(rel, "name"),
+		Namespace: str(rel, "namespace"),
+		Version:   int32(version),
+		Info:      &rspb.Info{Status: &rspb.Status{Code: code}},
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: str(metadata, "name"), Version: str(metadata, "version")}},
+		Manifest:  str(rel, "manifest"),
+	}, nil
+}
+
+// Helm3Supersede marks a stored Helm 3 revision as superseded.
+func Helm3Supersede(rev Revision, namespace string, clientset kubernetes.Interface) error {
+	secret, err := clientset.Core().Secrets(namespace).Get(rev.Key)
+	if err != nil {
+		return err
+	}
+	rel, err := decodeHelm3(secret.Data["release"])
+	if err != nil {
+		return err
+	}
+	status := helm3Status(rspb.Status_SUPERSEDED)
+	if info, ok := rel["info"].(map[string]interface{}); ok {
+		info["status"] = status
+	}
+	s, err := encodeHelm3(rel)
+	if err != nil {
+		return err
+	}
+	secret.Data["release"] = []byte(s)
+	secret.Labels["status"] = status
+	secret.Labels["modifiedAt"] = strconv.Itoa(int(time.Now().Unix()))
+	_, err = clientset.Core().Secrets(namespace).Update(secret)
+	return err
+}
+
+// Helm3Adopt sets the ownership metadata on objMeta so that Helm 3 treats the
+// object as part of the given release.
+func Helm3Adopt(objMeta *v1.ObjectMeta, releaseName, releaseNamespace string) {
+	if objMeta.Labels == nil {
+		objMeta.Labels = make(map[string]string)
+	}
+	if objMeta.Annotations == nil {
+		objMeta.Annotations = make(map[string]string)
+	}
+	objMeta.Labels[Helm3ManagedByLabel] = "Helm"
+	objMeta.Annotations[Helm3ReleaseNameAnnotation] = releaseName
+	objMeta.Annotations[Helm3ReleaseNamespaceAnnotation] = releaseNamespace
+}
+
+// AdoptObjects stamps the live objects with the Helm 3 ownership metadata.
+func AdoptObjects(kubeClient kubernetes.Interface, objs []ObjectRef, releaseName, releaseNamespace string) error {
+	objMeta := &v1.ObjectMeta{}
+	Helm3Adopt(objMeta, releaseName, releaseNamespace)
+	patch, err := metadataPatch(objMeta.Labels, objMeta.Annotations)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if err := PatchObject(kubeClient, obj, patch); err != nil {
+			return fmt.Errorf("adopting %s: %v", obj, err)
+		}
+	}
+	return nil
+}
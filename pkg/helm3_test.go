@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/timeconv"
+)
+
+func testRelease(version int32) *rspb.Release {
+	now := timeconv.Now()
+	return &rspb.Release{
+		Name:      "deis-workflow",
+		Namespace: "deis",
+		Version:   version,
+		Info:      &rspb.Info{FirstDeployed: now, LastDeployed: now, Status: &rspb.Status{Code: rspb.Status_DEPLOYED}},
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: "workflow", Version: "v2.7.0"}},
+		Config:    &chart.Config{Raw: "global:\n  storage: minio\n"},
+		Manifest:  "\n---\n# Source: workflow/charts/router/templates/router-service.yaml\nkind: Service\n",
+	}
+}
+
+func TestHelm3Create(t *testing.T) {
+	server, clientset := newTestServer(t)
+	defer server.Close()
+	rls := testRelease(1)
+	if err := Helm3Create(rls, clientset); err != nil {
+		t.Fatal(err)
+	}
+	err := Helm3Create(rls, clientset)
+	if err == nil || err.Error() != "release secret sh.helm.release.v1.deis-workflow.v1 already exists" {
+		t.Errorf("got %v creating an existing release secret", err)
+	}
+
+	secret, err := clientset.Core().Secrets("deis").Get("sh.helm.release.v1.deis-workflow.v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLabels := map[string]string{"name": "deis-workflow", "owner": "helm", "status": "deployed", "version": "1"}
+	for key, value := range wantLabels {
+		if secret.Labels[key] != value {
+			t.Errorf("got labels %v, want %v", secret.Labels, wantLabels)
+			break
+		}
+	}
+	if secret.Type != v1.SecretType(helm3SecretType) {
+		t.Errorf("got type %s", secret.Type)
+	}
+
+	rel, err := decodeHelm3(secret.Data["release"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rel["name"] != "deis-workflow" || rel["namespace"] != "deis" || rel["version"] != float64(1) || rel["manifest"] != rls.Manifest {
+		t.Errorf("got %v", rel)
+	}
+	info, _ := rel["info"].(map[string]interface{})
+	if info["status"] != "deployed" || info["first_deployed"] == nil {
+		t.Errorf("got info %v", info)
+	}
+	chartMap, _ := rel["chart"].(map[string]interface{})
+	metadata, _ := chartMap["metadata"].(map[string]interface{})
+	if metadata["name"] != "workflow" || metadata["version"] != "v2.7.0" || metadata["apiVersion"] != "v1" {
+		t.Errorf("got chart metadata %v", metadata)
+	}
+	want := map[string]interface{}{"global": map[string]interface{}{"storage": "minio"}}
+	if !reflect.DeepEqual(rel["config"], want) {
+		t.Errorf("got config %v, want %v", rel["config"], want)
+	}
+}
+
+func TestHelm3RoundTrip(t *testing.T) {
+	s, err := encodeHelm3Release(testRelease(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := decodeHelm3([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fields this tool doesn't model survive a decode and encode
+	rel["labels"] = map[string]interface{}{"team": "platform"}
+	s, err = encodeHelm3(rel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := decodeHelm3([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, rel) {
+		t.Errorf("got %v, want %v", again, rel)
+	}
+}
+
+func TestHelm3Supersede(t *testing.T) {
+	server, clientset := newTestServer(t)
+	defer server.Close()
+	for _, version := range []int32{1, 2} {
+		if err := Helm3Create(testRelease(version), clientset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revs, err := Helm3Revisions("deis-workflow", "deis", clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Revision{{"sh.helm.release.v1.deis-workflow.v1", 1, "deployed"}, {"sh.helm.release.v1.deis-workflow.v2", 2, "deployed"}}
+	if !reflect.DeepEqual(revs, want) {
+		t.Fatalf("got revisions %v, want %v", revs, want)
+	}
+
+	if err := Helm3Supersede(revs[0], "deis", clientset); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := clientset.Core().Secrets("deis").Get(revs[0].Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Labels["owner"] != "helm" || secret.Labels["status"] != "superseded" {
+		t.Errorf("got labels %v", secret.Labels)
+	}
+	rel, err := decodeHelm3(secret.Data["release"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := rel["info"].(map[string]interface{})["status"]; status != "superseded" {
+		t.Errorf("got status %v in the release", status)
+	}
+}
+
+func TestHelm3Adopt(t *testing.T) {
+	meta := v1.ObjectMeta{Labels: map[string]string{"heritage": "deis"}}
+	Helm3Adopt(&meta, "deis-workflow", "deis")
+	wantLabels := map[string]string{"heritage": "deis", Helm3ManagedByLabel: "Helm"}
+	wantAnnotations := map[string]string{Helm3ReleaseNameAnnotation: "deis-workflow", Helm3ReleaseNamespaceAnnotation: "deis"}
+	if !reflect.DeepEqual(meta.Labels, wantLabels) || !reflect.DeepEqual(meta.Annotations, wantAnnotations) {
+		t.Errorf("got labels %v and annotations %v", meta.Labels, meta.Annotations)
+	}
+}
+
+func TestGetHelm3Release(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	stored := testRelease(2)
+	if err := Helm3Create(stored, clientset); err != nil {
+		t.Fatal(err)
+	}
+	rls, err := GetHelm3Release(Helm3SecretName("deis-workflow", 2), "deis", clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rls.Name != "deis-workflow" || rls.Namespace != "deis" || rls.Version != 2 || rls.Manifest != stored.Manifest {
+		t.Errorf("got release %s/%s revision %d with manifest %q", rls.Namespace, rls.Name, rls.Version, rls.Manifest)
+	}
+	if code := rls.Info.Status.Code; code != rspb.Status_DEPLOYED {
+		t.Errorf("got status %s", code)
+	}
+	if md := rls.Chart.Metadata; md.Name != "workflow" || md.Version != "v2.7.0" {
+		t.Errorf("got chart %s %s", md.Name, md.Version)
+	}
+	if _, err := GetHelm3Release(Helm3SecretName("deis-workflow", 3), "deis", clientset); err == nil {
+		t.Error("read a revision that doesn't exist")
+	}
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+func TestTillerCreate(t *testing.T) {
+	for _, storage := range []string{StorageConfigMap, StorageSecret} {
+		server, clientset := newTestServer(t)
+		defer server.Close()
+		rls := testRelease(1)
+		if err := TillerCreate(storage, "deis-workflow.v1", rls, DefaultTillerNamespace, clientset); err != nil {
+			t.Fatalf("%s: %v", storage, err)
+		}
+		err := TillerCreate(storage, "deis-workflow.v1", rls, DefaultTillerNamespace, clientset)
+		if err == nil || err.Error() != "release deis-workflow.v1 already exists" {
+			t.Errorf("%s: storing an existing revision again: got %v", storage, err)
+		}
+
+		var data string
+		var lbs map[string]string
+		switch storage {
+		case StorageConfigMap:
+			cfg, err := clientset.Core().ConfigMaps(DefaultTillerNamespace).Get("deis-workflow.v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, lbs = cfg.Data["release"], cfg.Labels
+		case StorageSecret:
+			secret, err := clientset.Core().Secrets(DefaultTillerNamespace).Get("deis-workflow.v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, lbs = string(secret.Data["release"]), secret.Labels
+		}
+		if lbs["NAME"] != "deis-workflow" || lbs["OWNER"] != "TILLER" || lbs["STATUS"] != "DEPLOYED" || lbs["VERSION"] != "1" {
+			t.Errorf("%s: got labels %v", storage, lbs)
+		}
+
+		decoded, err := decodeRelease(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(decoded, rls) {
+			t.Errorf("%s: got %v, want %v", storage, decoded, rls)
+		}
+	}
+}
+
+func TestReleaseRoundTrip(t *testing.T) {
+	rls := testRelease(1)
+	s, err := encodeRelease(rls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeRelease(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, rls) {
+		t.Errorf("got %v, want %v", decoded, rls)
+	}
+
+	// releases stored before Tiller compressed them are read as well
+	b, err := proto.Marshal(rls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = decodeRelease(b64.EncodeToString(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, rls) {
+		t.Errorf("got %v, want %v", decoded, rls)
+	}
+}
+
+func TestTillerSupersede(t *testing.T) {
+	for _, storage := range []string{StorageConfigMap, StorageSecret} {
+		server, clientset := newTestServer(t)
+		defer server.Close()
+		for _, version := range []int32{1, 2} {
+			if err := TillerCreate(storage, fmt.Sprintf("deis-workflow.v%d", version), testRelease(version), DefaultTillerNamespace, clientset); err != nil {
+				t.Fatalf("%s: %v", storage, err)
+			}
+		}
+
+		revs, err := TillerRevisions(storage, "deis-workflow", DefaultTillerNamespace, clientset)
+		if err != nil {
+			t.Fatalf("%s: %v", storage, err)
+		}
+		want := []Revision{{"deis-workflow.v1", 1, "DEPLOYED"}, {"deis-workflow.v2", 2, "DEPLOYED"}}
+		if !reflect.DeepEqual(revs, want) {
+			t.Fatalf("%s: got revisions %v, want %v", storage, revs, want)
+		}
+
+		if err := TillerSupersede(storage, revs[0], DefaultTillerNamespace, clientset); err != nil {
+			t.Fatalf("%s: %v", storage, err)
+		}
+		var data string
+		var lbs map[string]string
+		switch storage {
+		case StorageConfigMap:
+			cfg, err := clientset.Core().ConfigMaps(DefaultTillerNamespace).Get("deis-workflow.v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, lbs = cfg.Data["release"], cfg.Labels
+		case StorageSecret:
+			secret, err := clientset.Core().Secrets(DefaultTillerNamespace).Get("deis-workflow.v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, lbs = string(secret.Data["release"]), secret.Labels
+		}
+		if lbs["STATUS"] != "SUPERSEDED" || lbs["MODIFIED_AT"] == "" {
+			t.Errorf("%s: got labels %v", storage, lbs)
+		}
+		rls, err := decodeRelease(data)
+		if err != nil {
+			t.Fatalf("%s: %v", storage, err)
+		}
+		if code := rls.Info.Status.Code; code != rspb.Status_SUPERSEDED {
+			t.Errorf("%s: got status %s in the release", storage, code)
+		}
+		if rls.Manifest != testRelease(1).Manifest {
+			t.Errorf("%s: the manifest changed: %q", storage, rls.Manifest)
+		}
+
+		revs, err = TillerRevisions(storage, "deis-workflow", DefaultTillerNamespace, clientset)
+		if err != nil {
+			t.Fatalf("%s: %v", storage, err)
+		}
+		if revs[0].Status != "SUPERSEDED" || revs[1].Status != "DEPLOYED" {
+			t.Errorf("%s: got revisions %v", storage, revs)
+		}
+	}
+}
+
+func TestTillerUnknownStorage(t *testing.T) {
+	server, clientset := newTestServer(t)
+	defer server.Close()
+	if err := TillerCreate("sql", "deis-workflow.v1", testRelease(1), DefaultTillerNamespace, clientset); err == nil {
+		t.Error("TillerCreate accepted an unknown storage driver")
+	}
+	if _, err := TillerRevisions("sql", "deis-workflow", DefaultTillerNamespace, clientset); err == nil {
+		t.Error("TillerRevisions accepted an unknown storage driver")
+	}
+	if err := TillerSupersede("sql", Revision{Key: "deis-workflow.v1"}, DefaultTillerNamespace, clientset); err == nil {
+		t.Error("TillerSupersede accepted an unknown storage driver")
+	}
+}
+
+func TestDetectTillerStorage(t *testing.T) {
+	tests := []struct {
+		command, args []string
+		want          string
+	}{
+		{[]string{"/tiller"}, nil, StorageConfigMap},
+		{[]string{"/tiller"}, []string{"--storage=secret"}, StorageSecret},
+		{[]string{"/tiller", "--storage", "secret"}, nil, StorageSecret},
+		{nil, []string{"--storage=configmap"}, StorageConfigMap},
+	}
+	for _, test := range tests {
+		server, clientset := newTestServer(t)
+		defer server.Close()
+		server.discover("extensions/v1beta1", "Deployment")
+		server.add(t, "/apis/extensions/v1beta1/namespaces/kube-system/deployments", &v1beta1.Deployment{
+			ObjectMeta: v1.ObjectMeta{Name: "tiller-deploy"},
+			Spec: v1beta1.DeploymentSpec{Template: v1.PodTemplateSpec{Spec: v1.PodSpec{
+				Containers: []v1.Container{{Name: "tiller", Command: test.command, Args: test.args}},
+			}}},
+		})
+		got, err := DetectTillerStorage(clientset, DefaultTillerNamespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("command %v and args %v: got %q, want %q", test.command, test.args, got, test.want)
+		}
+	}
+
+	server, clientset := newTestServer(t)
+	defer server.Close()
+	server.discover("extensions/v1beta1", "Deployment")
+	if _, err := DetectTillerStorage(clientset, DefaultTillerNamespace); err == nil {
+		t.Error("detected a storage driver without a tiller deployment")
+	}
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/timeconv"
+)
+
+type storedObject struct {
+	Kind string            `json:"kind"`
+	Data map[string]string `json:"data"`
+}
+
+type releaseSummary struct {
+	Name          string `json:"name"`
+	Namespace     string `json:"namespace"`
+	Version       int32  `json:"version"`
+	Chart         string `json:"chart"`
+	Status        string `json:"status"`
+	FirstDeployed string `json:"firstDeployed"`
+	LastDeployed  string `json:"lastDeployed"`
+}
+
+// GetStoredRelease fetches and decodes the release revision stored under key by the
+// given Tiller storage driver.
+func GetStoredRelease(storage, key, namespace string, clientset kubernetes.Interface) (*rspb.Release, error) {
+	switch storage {
+	case StorageConfigMap:
+		cfg, err := clientset.Core().ConfigMaps(namespace).Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRelease(cfg.Data["release"])
+	case StorageSecret:
+		secret, err := clientset.Core().Secrets(namespace).Get(key)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRelease(string(secret.Data["release"]))
+	}
+	return nil, fmt.Errorf("unknown tiller storage driver %q", storage)
+}
+
+// ReadStoredRelease decodes the release held by a ConfigMap or Secret exported
+// with `kubectl get -o yaml` (or json).
+func ReadStoredRelease(data []byte) (*rspb.Release, error) {
+	obj := storedObject{}
+	if err := yaml.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	s, ok := obj.Data["release"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no release data", obj.Kind)
+	}
+	switch obj.Kind {
+	case "ConfigMap":
+		return decodeRelease(s)
+	case "Secret":
+		// secret data carries an extra layer of base64 from the API
+		b, err := b64.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return decodeRelease(string(b))
+	}
+	return nil, fmt.Errorf("unsupported kind %q, expected ConfigMap or Secret", obj.Kind)
+}
+
+// FormatRelease renders the release metadata, values and manifest as a YAML stream.
+func FormatRelease(rls *rspb.Release) (string, error) {
+	summary := releaseSummary{
+		Name:      rls.Name,
+		Namespace: rls.Namespace,
+		Version:   rls.Version,
+	}
+	if rls.Chart != nil && rls.Chart.Metadata != nil {
+		summary.Chart = rls.Chart.Metadata.Name + "-" + rls.Chart.Metadata.Version
+	}
+	if rls.Info != nil {
+		if rls.Info.Status != nil {
+			summary.Status = rls.Info.Status.Code.String()
+		}
+		summary.FirstDeployed = timeconv.String(rls.Info.FirstDeployed)
+		summary.LastDeployed = timeconv.String(rls.Info.LastDeployed)
+	}
+	y, err := yaml.Marshal(summary)
+	if err != nil {
+		return "", err
+	}
+
+	b := bytes.NewBuffer(nil)
+	b.WriteString("# Release\n")
+	b.Write(y)
+	b.WriteString("---\n# Values\n")
+	if rls.Config != nil {
+		b.WriteString(strings.TrimSpace(rls.Config.Raw) + "\n")
+	}
+	b.WriteString("---\n# Manifest\n")
+	b.WriteString(strings.TrimSpace(rls.Manifest) + "\n")
+	return b.String(), nil
+}
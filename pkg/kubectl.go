@@ -1,139 +1,129 @@
 package pkg
 
-// Most of the code in here is from the https://github.com/kubernetes/kubernetes/blob/master/pkg/kubectl/cmd/annotate.go and
-// changed appropriately for the use-case.
-
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
 
-	"github.com/ghodss/yaml"
 	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
 	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
-	"k8s.io/kubernetes/pkg/api"
-	"k8s.io/kubernetes/pkg/api/meta"
-	cmdutil "k8s.io/kubernetes/pkg/kubectl/cmd/util"
-	"k8s.io/kubernetes/pkg/kubectl/resource"
-	"k8s.io/kubernetes/pkg/runtime"
-	"k8s.io/kubernetes/pkg/util/strategicpatch"
 )
 
-// UpdateSecrets updates the secrets by adding the helm pre-install hook annotation
-func UpdateSecrets(kubeClient *kubernetes.Clientset, secrets []string) error {
-	succChan, errChan := make(chan string), make(chan error)
+// SecretStatus records the outcome of annotating a single secret.
+type SecretStatus struct {
+	Name      string
+	Found     bool
+	Annotated bool
+	Attempts  int
+	Err       error
+}
 
-	for _, secret := range secrets {
-		go updateSecret(kubeClient, secret, succChan, errChan)
-	}
-	for i := 0; i < len(secrets); i++ {
-		select {
-		case successMsg := <-succChan:
-			fmt.Println(successMsg)
-		case err := <-errChan:
-			fmt.Println(err)
-		}
+func (s SecretStatus) String() string {
+	switch {
+	case s.Err != nil:
+		return fmt.Sprintf("secret %s failed after %d attempt(s): %v", s.Name, s.Attempts, s.Err)
+	case !s.Found:
+		return fmt.Sprintf("secret %s not found", s.Name)
 	}
-	return nil
+	return fmt.Sprintf("secret %s annotated successfuly", s.Name)
 }
 
-// updateSecret annotates the secret if its present.
-func updateSecret(kubeClient *kubernetes.Clientset, secretName string, succChan chan<- string, errChan chan<- error) {
-	b := bytes.NewBuffer(nil)
-	// Secrets
-	secret, err := kubeClient.Secrets("deis").Get(secretName)
+// UpdateSecrets updates the secrets by adding the helm pre-install hook annotation.
+// Conflicts, timeouts and server errors are retried with backoff. The returned
+// error lists every existing secret that could not be annotated.
+func UpdateSecrets(kubeClient kubernetes.Interface, namespace string, secrets []string) ([]SecretStatus, error) {
+	patch, err := annotationsPatch(map[string]string{"helm.sh/hook": "pre-install"})
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			succChan <- fmt.Sprintf("secret %s not found", secretName)
-			return
-		}
-		errChan <- err
-		return
+		return nil, err
 	}
-	secretNameDet := strings.SplitN(secret.ObjectMeta.Name, "-", 2)
-	path := "workflow/charts/" + secretNameDet[1] + "templates/" + secretNameDet[1] + "-secret.yaml"
-	b.WriteString("\n---\n# Source: " + path + "\n")
-	secret.Kind = "Secret"
-	secret.APIVersion = "v1"
-	secret.ResourceVersion = ""
-	y, err := yaml.Marshal(secret)
-	if err != nil {
-		fmt.Printf("err: %v\n", err)
-		errChan <- err
-		return
-	}
-	b.WriteString(string(y))
+	statusChan := make(chan SecretStatus)
 
-	factory := cmdutil.NewFactory(nil)
-	current := factory.NewBuilder().ContinueOnError().NamespaceParam("deis").DefaultNamespace().Stream(b, "").Flatten().Do()
-	err = current.Visit(func(info *resource.Info, err error) error {
-		if err != nil {
-			return err
-		}
-
-		obj, err := cmdutil.MaybeConvertObject(info.Object, info.Mapping.GroupVersionKind.GroupVersion(), info.Mapping)
-		if err != nil {
-			return err
-		}
-		name, namespace := info.Name, info.Namespace
-		oldData, err := json.Marshal(obj)
-		if err != nil {
-			return err
-		}
-
-		if err := updateAnnotations(obj); err != nil {
-			return err
-		}
-		newData, err := json.Marshal(obj)
-		if err != nil {
-			return err
-		}
-		patchBytes, err := strategicpatch.CreateTwoWayMergePatch(oldData, newData, obj)
-		createdPatch := err == nil
-		if err != nil {
-			fmt.Printf("couldn't compute patch: %v", err)
-		}
-
-		mapping := info.ResourceMapping()
-		client, err := factory.ClientForMapping(mapping)
-		if err != nil {
-			return err
-		}
-		helper := resource.NewHelper(client, mapping)
+	for _, secret := range secrets {
+		go func(secretName string) {
+			status := SecretStatus{Name: secretName}
+			status.Attempts, status.Err = retry(retryAttempts, retryWait, func() error {
+				var err error
+				status.Found, err = updateSecret(kubeClient, namespace, secretName, patch)
+				return err
+			})
+			status.Annotated = status.Found && status.Err == nil
+			statusChan <- status
+		}(secret)
+	}
 
-		if createdPatch {
-			_, err = helper.Patch(namespace, name, api.StrategicMergePatchType, patchBytes)
-		} else {
-			_, err = helper.Replace(namespace, name, false, obj)
-		}
-		if err != nil {
-			return err
+	statusMap := make(map[string]SecretStatus)
+	for i := 0; i < len(secrets); i++ {
+		status := <-statusChan
+		statusMap[status.Name] = status
+	}
+	statuses := make([]SecretStatus, 0, len(secrets))
+	var failed []string
+	for _, secret := range secrets {
+		status := statusMap[secret]
+		statuses = append(statuses, status)
+		if status.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", status.Name, status.Err))
 		}
-		return nil
-	})
-	if err != nil {
-		errChan <- err
-		return
 	}
-	succChan <- fmt.Sprintf("secret %s annotated successfuly", secretName)
-}
-
-// updateAnnotations updates annotations of obj
-func updateAnnotations(obj runtime.Object) error {
-	accessor, err := meta.Accessor(obj)
-	if err != nil {
-		return err
+	if len(failed) > 0 {
+		return statuses, fmt.Errorf("failed to annotate secrets: %s", strings.Join(failed, "; "))
 	}
+	return statuses, nil
+}
 
-	annotations := accessor.GetAnnotations()
-	if annotations == nil {
-		annotations = make(map[string]string)
+// updateSecret annotates the secret if its present. It reports whether the secret exists.
+func updateSecret(kubeClient kubernetes.Interface, namespace, secretName string, patch []byte) (bool, error) {
+	err := PatchObject(kubeClient, ObjectRef{Kind: "Secret", Namespace: namespace, Name: secretName}, patch)
+	if apierrors.IsNotFound(err) {
+		return false, nil
 	}
+	return true, err
+}
 
-	annotations["helm.sh/hook"] = "pre-install"
+// annotationsPatch returns a merge patch that sets the given annotations.
+func annotationsPatch(annotations map[string]string) ([]byte, error) {
+	return metadataPatch(nil, annotations)
+}
 
-	accessor.SetAnnotations(annotations)
+// metadataPatch returns a merge patch that sets the given labels and annotations,
+// leaving every other label and annotation of the object alone.
+func metadataPatch(labels, annotations map[string]string) ([]byte, error) {
+	metadata := make(map[string]interface{})
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	return json.Marshal(map[string]interface{}{"metadata": metadata})
+}
 
-	return nil
+// PatchObject applies a JSON merge patch to the object referenced by obj.
+func PatchObject(kubeClient kubernetes.Interface, obj ObjectRef, patch []byte) error {
+	var err error
+	switch strings.ToLower(obj.Kind) {
+	case "serviceaccount":
+		_, err = kubeClient.Core().ServiceAccounts(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	case "secret":
+		_, err = kubeClient.Core().Secrets(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	case "configmap":
+		_, err = kubeClient.Core().ConfigMaps(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	case "service":
+		_, err = kubeClient.Core().Services(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	case "persistentvolumeclaim":
+		_, err = kubeClient.Core().PersistentVolumeClaims(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	case "replicationcontroller":
+		_, err = kubeClient.Core().ReplicationControllers(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	case "pod":
+		_, err = kubeClient.Core().Pods(obj.Namespace).Patch(obj.Name, api.MergePatchType, patch)
+	default:
+		// kinds outside the core group are patched in the version the server serves
+		var r APIResource
+		r, err = ResolveResource(kubeClient, obj.Kind)
+		if err == nil {
+			err = PatchResource(kubeClient, r, obj.Namespace, obj.Name, patch)
+		}
+	}
+	return err
 }
@@ -0,0 +1,122 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+)
+
+func TestUpdateSecretsRetries(t *testing.T) {
+	defer func(wait time.Duration) { retryWait = wait }(retryWait)
+	retryWait = time.Millisecond
+
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	for _, name := range []string{"minio-user", "database-creds"} {
+		s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{ObjectMeta: v1.ObjectMeta{Name: name}})
+	}
+	s.failNext("PATCH", "/api/v1/namespaces/deis/secrets/minio-user",
+		apierrors.NewConflict(secretsResource, "minio-user", errors.New("changed")),
+		apierrors.NewConflict(secretsResource, "minio-user", errors.New("changed")))
+	s.failNext("PATCH", "/api/v1/namespaces/deis/secrets/database-creds",
+		apierrors.NewForbidden(secretsResource, "database-creds", errors.New("denied")))
+
+	statuses, err := UpdateSecrets(clientset, "deis", []string{"minio-user", "database-creds", "objectstorage-keyfile"})
+	if err == nil {
+		t.Fatal("expected an error for the forbidden secret")
+	}
+	if len(statuses) != 3 {
+		t.Fatalf("got %d statuses, want 3", len(statuses))
+	}
+	if got := statuses[0]; got.Attempts != 3 || !got.Annotated || got.Err != nil {
+		t.Errorf("minio-user: got %+v, want 3 attempts and annotated", got)
+	}
+	if got := statuses[1]; got.Attempts != 1 || got.Annotated || got.Err == nil {
+		t.Errorf("database-creds: got %+v, want 1 attempt and an error", got)
+	}
+	if got := statuses[2]; got.Found || got.Err != nil {
+		t.Errorf("objectstorage-keyfile: got %+v, want not found", got)
+	}
+	annotations := mapField(mapField(s.get("/api/v1/namespaces/deis/secrets/minio-user"), "metadata"), "annotations")
+	if annotations["helm.sh/hook"] != "pre-install" {
+		t.Errorf("minio-user annotations = %v, want the pre-install hook", annotations)
+	}
+}
+
+func TestPatchObject(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.discover("extensions/v1beta1", "Deployment")
+	s.add(t, "/api/v1/namespaces/deis/services", &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "deis-router"}})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "deis-router"}})
+
+	patch, err := metadataPatch(map[string]string{"heritage": "Tiller"}, map[string]string{"helm.sh/hook": "pre-install"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		obj  ObjectRef
+		path string
+	}{
+		{ObjectRef{Kind: "Service", Namespace: "deis", Name: "deis-router"}, "/api/v1/namespaces/deis/services/deis-router"},
+		{ObjectRef{Kind: "Deployment", Namespace: "deis", Name: "deis-router"}, "/apis/extensions/v1beta1/namespaces/deis/deployments/deis-router"},
+	}
+	for _, test := range tests {
+		if err := PatchObject(clientset, test.obj, patch); err != nil {
+			t.Errorf("%s: %v", test.obj.Kind, err)
+			continue
+		}
+		metadata := mapField(s.get(test.path), "metadata")
+		if mapField(metadata, "labels")["heritage"] != "Tiller" || mapField(metadata, "annotations")["helm.sh/hook"] != "pre-install" {
+			t.Errorf("%s: metadata after patch = %v", test.obj.Kind, metadata)
+		}
+	}
+
+	if err := PatchObject(clientset, ObjectRef{Kind: "Deployment", Namespace: "deis", Name: "missing"}, patch); !apierrors.IsNotFound(err) {
+		t.Errorf("patching a missing object: got %v, want not found", err)
+	}
+	if err := PatchObject(clientset, ObjectRef{Kind: "CronJob", Namespace: "deis", Name: "backup"}, patch); err == nil {
+		t.Error("expected an error for an unsupported kind")
+	}
+}
+
+func TestPatchObjectResolve(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	// apps is preferred, but only extensions serves deployments on this server
+	s.discover("apps/v1beta1", "StatefulSet")
+	s.discover("extensions/v1beta1", "Deployment", "DaemonSet", "Ingress")
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "deis-router"}})
+
+	patch, err := annotationsPatch(map[string]string{"helm.sh/hook": "pre-install"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PatchObject(clientset, ObjectRef{Kind: "Deployment", Namespace: "deis", Name: "deis-router"}, patch); err != nil {
+		t.Fatal(err)
+	}
+	if s.count("PATCH", "/apis/extensions/v1beta1/namespaces/deis/deployments/deis-router") != 1 {
+		t.Error("expected the deployment to be patched through extensions/v1beta1")
+	}
+	r, err := ResolveResource(clientset, "Ingress")
+	if err != nil || r.APIVersion() != "extensions/v1beta1" || r.Resource != "ingresses" {
+		t.Errorf("got %+v (%v), want ingresses in extensions/v1beta1", r, err)
+	}
+
+	s2, clientset2 := newTestServer(t)
+	defer s2.Close()
+	s2.discover("apps/v1", "Deployment")
+	s2.discover("apps/v1beta2", "Deployment")
+	s2.discover("extensions/v1beta1", "Deployment")
+	r, err = ResolveResource(clientset2, "Deployment")
+	if err != nil || r.APIVersion() != "apps/v1" {
+		t.Errorf("got %+v (%v), want the preferred apps/v1", r, err)
+	}
+	if _, err := ResolveResource(clientset2, "DaemonSet"); err == nil {
+		t.Error("expected an error for a kind the server doesn't serve")
+	}
+}
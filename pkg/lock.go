@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+// LockConfigMap is the configmap holding the lease that makes sure only one
+// migration runs against a cluster at a time.
+const LockConfigMap = "workflow-migration-lock"
+
+// Lock is a lease on LockConfigMap. It expires unless it is renewed.
+type Lock struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	holder     string
+	duration   time.Duration
+
+	once     sync.Once
+	renewing bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// AcquireLock takes the migration lock in namespace for holder. An expired lease
+// is taken over; a lease still held by someone else is an error naming its holder.
+func AcquireLock(kubeClient kubernetes.Interface, namespace, holder string, duration time.Duration) (*Lock, error) {
+	l := &Lock{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		holder:     holder,
+		duration:   duration,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	now := time.Now()
+	cfg := &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:   LockConfigMap,
+			Labels: map[string]string{"heritage": "workflow-migration"},
+		},
+		Data: l.leaseData(now, now),
+	}
+	_, err := kubeClient.Core().ConfigMaps(namespace).Create(cfg)
+	if err == nil {
+		return l, nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	existing, err := kubeClient.Core().ConfigMaps(namespace).Get(LockConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	expires, err := time.Parse(time.RFC3339, existing.Data["expiresAt"])
+	if err == nil && now.Before(expires) && existing.Data["holder"] != holder {
+		return nil, fmt.Errorf("migration lock is held by %s until %s, use --force-unlock if it is stale", existing.Data["holder"], existing.Data["expiresAt"])
+	}
+	// the update fails with a conflict if another run takes over the lease first
+	existing.Data = l.leaseData(now, now)
+	if _, err := kubeClient.Core().ConfigMaps(namespace).Update(existing); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Lock) leaseData(acquired, renewed time.Time) map[string]string {
+	return map[string]string{
+		"holder":     l.holder,
+		"acquiredAt": acquired.Format(time.RFC3339),
+		"renewedAt":  renewed.Format(time.RFC3339),
+		"expiresAt":  renewed.Add(l.duration).Format(time.RFC3339),
+	}
+}
+
+// KeepRenewed renews the lease in the background until the lock is released.
+// lost is called if the lease was taken over by someone else or can't be renewed
+// before it expires.
+func (l *Lock) KeepRenewed(lost func(error)) {
+	l.renewing = true
+	go func() {
+		ticker := time.NewTicker(l.duration / 3)
+		defer ticker.Stop()
+		lastRenewed := time.Now()
+		for {
+			select {
+			case <-l.stop:
+				close(l.done)
+				return
+			case <-ticker.C:
+				err := l.renew()
+				if err == nil {
+					lastRenewed = time.Now()
+					continue
+				}
+				if _, ok := err.(lockLostError); ok || time.Since(lastRenewed) > l.duration {
+					// done is closed first so that lost may call Release
+					close(l.done)
+					lost(err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+type lockLostError struct {
+	holder string
+}
+
+func (e lockLostError) Error() string {
+	return fmt.Sprintf("migration lock was taken over by %s", e.holder)
+}
+
+func (l *Lock) renew() error {
+	cfg, err := l.kubeClient.Core().ConfigMaps(l.namespace).Get(LockConfigMap)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return lockLostError{holder: "nobody (the lock was removed)"}
+		}
+		return err
+	}
+	if cfg.Data["holder"] != l.holder {
+		return lockLostError{holder: cfg.Data["holder"]}
+	}
+	acquired, err := time.Parse(time.RFC3339, cfg.Data["acquiredAt"])
+	if err != nil {
+		acquired = time.Now()
+	}
+	cfg.Data = l.leaseData(acquired, time.Now())
+	_, err = l.kubeClient.Core().ConfigMaps(l.namespace).Update(cfg)
+	return err
+}
+
+// Release stops renewing the lease and removes it if it is still ours. It is safe
+// to call more than once.
+func (l *Lock) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		if l.renewing {
+			<-l.done
+		}
+		cfg, getErr := l.kubeClient.Core().ConfigMaps(l.namespace).Get(LockConfigMap)
+		if getErr != nil {
+			if !apierrors.IsNotFound(getErr) {
+				err = getErr
+			}
+			return
+		}
+		if cfg.Data["holder"] != l.holder {
+			return
+		}
+		err = l.kubeClient.Core().ConfigMaps(l.namespace).Delete(LockConfigMap, &api.DeleteOptions{})
+	})
+	return err
+}
+
+// ForceUnlock removes the migration lock whoever holds it.
+func ForceUnlock(kubeClient kubernetes.Interface, namespace string) error {
+	err := kubeClient.Core().ConfigMaps(namespace).Delete(LockConfigMap, &api.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
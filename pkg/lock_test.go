@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+const lockPath = "/api/v1/namespaces/deis/configmaps/" + LockConfigMap
+
+func addLease(t *testing.T, s *testServer, holder string, expires time.Time) {
+	s.add(t, "/api/v1/namespaces/deis/configmaps", &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: LockConfigMap},
+		Data: map[string]string{
+			"holder":     holder,
+			"acquiredAt": expires.Add(-time.Hour).Format(time.RFC3339),
+			"renewedAt":  expires.Add(-time.Hour).Format(time.RFC3339),
+			"expiresAt":  expires.Format(time.RFC3339),
+		},
+	})
+}
+
+func lockHolder(s *testServer) interface{} {
+	return mapField(s.get(lockPath), "data")["holder"]
+}
+
+func TestAcquireLock(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+
+	l, err := AcquireLock(clientset, "deis", "run-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lockHolder(s) != "run-1" {
+		t.Errorf("holder = %v, want run-1", lockHolder(s))
+	}
+	_, err = AcquireLock(clientset, "deis", "run-2", time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "held by run-1") {
+		t.Errorf("got %v, want the lock reported as held by run-1", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if s.get(lockPath) != nil {
+		t.Error("expected Release to remove the lease")
+	}
+	if err := l.Release(); err != nil {
+		t.Errorf("second Release: %v", err)
+	}
+}
+
+func TestAcquireLockTakeover(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addLease(t, s, "crashed-run", time.Now().Add(-time.Minute))
+
+	l, err := AcquireLock(clientset, "deis", "run-1", time.Hour)
+	if err != nil {
+		t.Fatalf("an expired lease should be taken over: %v", err)
+	}
+	if lockHolder(s) != "run-1" {
+		t.Errorf("holder = %v, want run-1", lockHolder(s))
+	}
+	expires, err := time.Parse(time.RFC3339, mapField(s.get(lockPath), "data")["expiresAt"].(string))
+	if err != nil || !expires.After(time.Now().Add(50*time.Minute)) {
+		t.Errorf("expiresAt = %v (%v), want about an hour from now", expires, err)
+	}
+
+	// another run taking over the lease keeps Release from removing it
+	addLease(t, s, "run-2", time.Now().Add(time.Hour))
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if lockHolder(s) != "run-2" {
+		t.Errorf("holder = %v, want run-2 to keep the lease", lockHolder(s))
+	}
+	if err := ForceUnlock(clientset, "deis"); err != nil {
+		t.Fatal(err)
+	}
+	if s.get(lockPath) != nil {
+		t.Error("expected ForceUnlock to remove the lease")
+	}
+	if err := ForceUnlock(clientset, "deis"); err != nil {
+		t.Errorf("ForceUnlock without a lease: %v", err)
+	}
+}
+
+func TestKeepRenewedLost(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addLease(t, s, "run-1", time.Now().Add(time.Hour))
+
+	l, err := AcquireLock(clientset, "deis", "run-1", 30*time.Millisecond)
+	if err != nil {
+		t.Fatalf("the holder should be able to take its own lease again: %v", err)
+	}
+	lost := make(chan error, 1)
+	l.KeepRenewed(func(err error) { lost <- err })
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-lost:
+		t.Fatalf("lease lost while renewing: %v", err)
+	default:
+	}
+
+	addLease(t, s, "run-2", time.Now().Add(time.Hour))
+	select {
+	case err := <-lost:
+		if _, ok := err.(lockLostError); !ok || !strings.Contains(err.Error(), "run-2") {
+			t.Errorf("got %v, want the lease reported as taken over by run-2", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lost was not called after the lease was taken over")
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if lockHolder(s) != "run-2" {
+		t.Errorf("holder = %v, want run-2", lockHolder(s))
+	}
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+)
+
+// ManifestFile is a file of the rendered manifests/ directory of a helm-classic
+// workspace, with the objects it holds.
+type ManifestFile struct {
+	Name    string
+	Objects []Object
+}
+
+// ReadManifestDir reads the YAML files of a helm-classic manifests/ directory, in
+// name order.
+func ReadManifestDir(dir string) ([]ManifestFile, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []ManifestFile
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if info.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		objs, err := parseObjects(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", info.Name(), err)
+		}
+		files = append(files, ManifestFile{Name: info.Name(), Objects: objs})
+	}
+	return files, nil
+}
+
+// parseObjects returns the objects of a multi-document YAML stream. Documents
+// without a kind, such as those holding only comments, are skipped.
+func parseObjects(data string) ([]Object, error) {
+	var objs []Object
+	for _, doc := range docSeparator.Split(data, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		obj := Object{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, err
+		}
+		if obj.Kind() == "" {
+			continue
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// Kind returns the kind of the object.
+func (o Object) Kind() string {
+	kind, _ := o["kind"].(string)
+	return kind
+}
+
+// Ref returns a reference to the object, placing it in namespace if it doesn't
+// name one.
+func (o Object) Ref(namespace string) ObjectRef {
+	ref := ObjectRef{Kind: o.Kind(), Namespace: namespace}
+	if metadata, ok := o["metadata"].(map[string]interface{}); ok {
+		if name, ok := metadata["name"].(string); ok {
+			ref.Name = name
+		}
+		if ns, ok := metadata["namespace"].(string); ok && ns != "" {
+			ref.Namespace = ns
+		}
+	}
+	return ref
+}
+
+// TemplatePaths maps "Kind/name" of every object with a fixed name in the chart
+// templates to the path of its template.
+func TemplatePaths(templates map[string]string) map[string]string {
+	paths := make(map[string]string)
+	for path, template := range templates {
+		for _, doc := range docSeparator.Split(template, -1) {
+			kind := kindLine.FindStringSubmatch(doc)
+			if kind == nil {
+				continue
+			}
+			if name := metadataName(doc); name != "" {
+				paths[kind[1]+"/"+name] = path
+			}
+		}
+	}
+	return paths
+}
+
+// SourcePath returns the template path of the new chart for an object of the
+// manifest file. Objects the chart doesn't name are placed in the subchart of their
+// component, in a template named like the helm-classic file.
+func SourcePath(file string, obj Object, templatePaths map[string]string) string {
+	ref := obj.Ref("")
+	if path, ok := templatePaths[ref.Kind+"/"+ref.Name]; ok {
+		return path
+	}
+	component := strings.TrimPrefix(ref.Name, "deis-")
+	return "workflow/charts/" + component + "/templates/" + strings.TrimPrefix(file, "deis-")
+}
+
+// MissingObjects returns the objects that don't exist in the cluster, and the
+// objects of kinds the workflow charts don't use, which can't be looked up and are
+// not checked.
+func MissingObjects(kubeClient kubernetes.Interface, objs []ObjectRef) ([]ObjectRef, []ObjectRef, error) {
+	var missing, unchecked []ObjectRef
+	for _, obj := range objs {
+		// only whether the object could be fetched matters here, not its health
+		_, err := objectHealth(kubeClient, obj, nil)
+		if _, ok := err.(notCheckedError); ok {
+			unchecked = append(unchecked, obj)
+			continue
+		}
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, nil, fmt.Errorf("%s: %v", obj, err)
+			}
+			missing = append(missing, obj)
+		}
+	}
+	sort.Sort(byRef(missing))
+	sort.Sort(byRef(unchecked))
+	return missing, unchecked, nil
+}
+
+// coreResources are the core API resources of the kinds MissingObjects looks up.
+var coreResources = map[string]string{
+	"ReplicationController": "replicationcontrollers",
+	"Service":               "services",
+	"Secret":                "secrets",
+	"ConfigMap":             "configmaps",
+	"ServiceAccount":        "serviceaccounts",
+	"PersistentVolumeClaim": "persistentvolumeclaims",
+}
+
+// LookupPermissions returns the permissions MissingObjects needs to look up objs.
+// Kinds it doesn't look up need none.
+func LookupPermissions(kubeClient kubernetes.Interface, objs []ObjectRef) ([]Permission, error) {
+	var perms []Permission
+	for _, obj := range objs {
+		switch obj.Kind {
+		case "Deployment", "DaemonSet":
+			r, err := ResolveResource(kubeClient, obj.Kind)
+			if err != nil {
+				return nil, err
+			}
+			perms = append(perms, Permission{Namespace: obj.Namespace, Group: r.Group, Resource: r.Resource, Verb: "get"})
+		default:
+			if resource, ok := coreResources[obj.Kind]; ok {
+				perms = append(perms, Permission{Namespace: obj.Namespace, Resource: resource, Verb: "get"})
+			}
+		}
+	}
+	return uniquePermissions(perms), nil
+}
+
+type byRef []ObjectRef
+
+func (r byRef) Len() int           { return len(r) }
+func (r byRef) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRef) Less(i, j int) bool { return r[i].String() < r[j].String() }
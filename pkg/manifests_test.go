@@ -0,0 +1,179 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+func TestReadManifestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workflow-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"deis-router-rc.yaml":       "# the router\napiVersion: v1\nkind: ReplicationController\nmetadata:\n  name: deis-router\n",
+		"deis-namespace.yaml":       "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: deis\n",
+		"deis-database-creds.yml":   "---\n# comment only\n---\nkind: Secret\nmetadata:\n  name: database-creds\n",
+		"README.md":                 "kind: Secret\n",
+		"deis-builder/ignored.yaml": "kind: Secret\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifests, err := ReadManifestDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range manifests {
+		names = append(names, file.Name)
+		if len(file.Objects) != 1 {
+			t.Errorf("%s: got %d objects, want 1", file.Name, len(file.Objects))
+		}
+	}
+	if want := []string{"deis-database-creds.yml", "deis-namespace.yaml", "deis-router-rc.yaml"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+}
+
+func TestSourcePath(t *testing.T) {
+	templatePaths := TemplatePaths(map[string]string{
+		"workflow/charts/router/templates/router-deployment.yaml": "apiVersion: extensions/v1beta1\nkind: Deployment\nmetadata:\n  name: deis-router\n",
+	})
+	tests := []struct {
+		file, kind, name, want string
+	}{
+		{"deis-router-rc.yaml", "Deployment", "deis-router", "workflow/charts/router/templates/router-deployment.yaml"},
+		{"deis-router-service.yaml", "Service", "deis-router", "workflow/charts/router/templates/router-service.yaml"},
+		{"deis-logger-fluentd-daemon.yaml", "DaemonSet", "deis-logger-fluentd", "workflow/charts/logger-fluentd/templates/logger-fluentd-daemon.yaml"},
+	}
+	for _, test := range tests {
+		obj := Object{"kind": test.kind, "metadata": map[string]interface{}{"name": test.name}}
+		if got := SourcePath(test.file, obj, templatePaths); got != test.want {
+			t.Errorf("SourcePath(%q, %s/%s) = %q, want %q", test.file, test.kind, test.name, got, test.want)
+		}
+	}
+}
+
+func TestMissingObjects(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "database-creds"}})
+	s.add(t, "/api/v1/namespaces/deis/services", &v1.Service{ObjectMeta: v1.ObjectMeta{Name: "deis-router"}})
+
+	missing, unchecked, err := MissingObjects(clientset, []ObjectRef{
+		{"Service", "deis", "deis-router"},
+		{"Secret", "deis", "database-creds"},
+		{"Service", "deis", "deis-workflow-manager"},
+		{"Ingress", "deis", "deis-router"},
+		{"Secret", "deis", "builder-key-auth"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ObjectRef{{"Secret", "deis", "builder-key-auth"}, {"Service", "deis", "deis-workflow-manager"}}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("got %v, want %v", missing, want)
+	}
+	if want := []ObjectRef{{"Ingress", "deis", "deis-router"}}; !reflect.DeepEqual(unchecked, want) {
+		t.Errorf("got unchecked %v, want %v", unchecked, want)
+	}
+}
+
+func TestManifestFromFiles(t *testing.T) {
+	files := []ManifestFile{
+		{Name: "deis-namespace.yaml", Objects: []Object{
+			{"apiVersion": "v1", "kind": "Namespace", "metadata": map[string]interface{}{"name": "deis"}},
+		}},
+		{Name: "deis-database-secret-creds.yaml", Objects: []Object{
+			{"apiVersion": "v1", "kind": "Secret", "metadata": map[string]interface{}{"name": "database-creds"}},
+		}},
+		{Name: "deis-router.yaml", Objects: []Object{
+			{"apiVersion": "extensions/v1beta1", "kind": "Deployment", "metadata": map[string]interface{}{"name": "deis-router", "namespace": "deis"}},
+			{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "database-creds"}},
+		}},
+	}
+	apiVersions := map[string]string{"Deployment": "apps/v1"}
+	templatePaths := map[string]string{"Deployment/deis-router": "workflow/charts/router/templates/router-deployment.yaml"}
+	objs := ManifestFromFiles(files, "deis", []string{"database-creds"}, apiVersions, templatePaths)
+
+	var sources []string
+	for _, obj := range objs {
+		sources = append(sources, obj.Source)
+	}
+	want := []string{"workflow/charts/router/templates/router-deployment.yaml", "workflow/charts/database-creds/templates/router.yaml"}
+	if !reflect.DeepEqual(sources, want) {
+		t.Fatalf("got sources %v, want %v", sources, want)
+	}
+	if v := objs[0].Object["apiVersion"]; v != "apps/v1" {
+		t.Errorf("got apiVersion %v for the deployment, want apps/v1", v)
+	}
+	if v := objs[1].Object["apiVersion"]; v != "v1" {
+		t.Errorf("got apiVersion %v for the configmap, want v1", v)
+	}
+	refs := ManifestRefs(objs, "deis")
+	wantRefs := []ObjectRef{{"Deployment", "deis", "deis-router"}, {"ConfigMap", "deis", "database-creds"}}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("got refs %v, want %v", refs, wantRefs)
+	}
+}
+
+func TestStampObjects(t *testing.T) {
+	obj := parseObject(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-router
+  labels:
+    heritage: deis
+spec:
+  ports:
+  - port: 80
+`)
+	objs := []ManifestObject{{Source: "workflow/charts/router/templates/router-service.yaml", Object: obj}}
+	err := StampObjects(objs, func(kind string, objMeta *v1.ObjectMeta) {
+		Helm3Adopt(objMeta, "deis-workflow", "deis")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := parseObject(t, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-router
+  labels:
+    heritage: deis
+    app.kubernetes.io/managed-by: Helm
+  annotations:
+    meta.helm.sh/release-name: deis-workflow
+    meta.helm.sh/release-namespace: deis
+spec:
+  ports:
+  - port: 80
+`)
+	if !reflect.DeepEqual(obj, want) {
+		t.Errorf("got %v, want %v", obj, want)
+	}
+
+	manifest, err := RenderManifest(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(manifest, "\n---\n# Source: workflow/charts/router/templates/router-service.yaml\napiVersion: v1\n") {
+		t.Errorf("unexpected manifest:\n%s", manifest)
+	}
+}
@@ -0,0 +1,467 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.5/kubernetes"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/labels"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/timeconv"
+)
+
+// Release formats a Migrator can write.
+const (
+	TargetHelm2 = "helm2"
+	TargetHelm3 = "helm3"
+)
+
+// Steps of a migration, passed to Hooks.AfterStep.
+const (
+	StepValues    = "reading values"
+	StepSecrets   = "updating secrets"
+	StepAnnotate  = "annotating secrets"
+	StepProtect   = "protecting stateful objects"
+	StepDelete    = "deleting deployments"
+	StepManifest  = "building the manifest"
+	StepRelease   = "writing the release"
+	StepSupersede = "superseding revisions"
+)
+
+// Hooks let the caller keep what a migration changes and watch it as it goes.
+type Hooks struct {
+	// Backup is given every secret before it is changed and every deployment
+	// before it is deleted; a failing backup stops the migration. A migration
+	// without Backup only runs as a dry run.
+	Backup func(kind, name string, obj interface{}) error
+	// AfterStep is called after every step with the result so far; an error stops
+	// the migration.
+	AfterStep func(step string, result *Result) error
+}
+
+// Options configure a Migrator. Fields left empty take the defaults of the
+// migration job.
+type Options struct {
+	// Namespace is the namespace workflow is installed in, "deis" by default.
+	Namespace string
+	// TillerNamespace is the namespace Tiller runs and stores releases in,
+	// DefaultTillerNamespace by default.
+	TillerNamespace string
+	// ReleaseName is the name of the release, "deis-workflow" by default.
+	ReleaseName string
+	// Version is the workflow version recorded as the chart version, "v2.7.0" by
+	// default.
+	Version string
+	// Target is the release format, TargetHelm2 by default.
+	Target string
+	// Storage is the Tiller storage driver, detected from tiller-deploy if empty.
+	Storage string
+	// Supersede writes the next revision of an existing release instead of refusing.
+	Supersede bool
+	// Params is the generate_params.toml of the helm-classic install to take the
+	// values from, the values are read from the cluster alone if empty.
+	Params []byte
+	// Selector picks the live objects of the manifest, heritage=deis by default.
+	Selector labels.Selector
+	// ManifestFiles are the helm-classic manifests to build the manifest from
+	// instead of the live objects, placed with TemplatePaths.
+	ManifestFiles []ManifestFile
+	TemplatePaths map[string]string
+	// HookSecrets are the secrets kept out of the manifest and annotated as
+	// pre-install hooks, DefaultHookSecrets by default.
+	HookSecrets []string
+	// APIVersions are the apiVersions the manifest records, by kind.
+	APIVersions map[string]string
+	// Protected are the objects marked to be kept by `helm delete`.
+	Protected []ObjectRef
+	// DryRun computes the result without changing the cluster.
+	DryRun bool
+	Hooks  Hooks
+}
+
+// Plan is what a migration is going to write, worked out without changing
+// anything.
+type Plan struct {
+	Storage   string
+	Version   int32
+	Revisions []Revision
+}
+
+// Deployed returns the revisions the migration supersedes.
+func (p *Plan) Deployed() []Revision {
+	var deployed []Revision
+	for _, rev := range p.Revisions {
+		if strings.EqualFold(rev.Status, rspb.Status_DEPLOYED.String()) {
+			deployed = append(deployed, rev)
+		}
+	}
+	return deployed
+}
+
+// Result is what a migration wrote, or would write on a dry run.
+type Result struct {
+	Plan          *Plan
+	Values        *Values
+	RawValues     string
+	Mutations     []SecretMutation
+	Disagreements []string
+	UnknownParams []string
+	Secrets       []SecretStatus
+	Deleted       []string
+	Objects       []ManifestObject
+	Manifest      string
+	Release       *rspb.Release
+	Key           string
+	Superseded    []Revision
+}
+
+// ReleaseExistsError is returned by Plan when the release already has revisions
+// and Supersede isn't set.
+type ReleaseExistsError struct {
+	Name   string
+	Latest Revision
+}
+
+func (e *ReleaseExistsError) Error() string {
+	return fmt.Sprintf("release %s already exists at revision %d (%s)", e.Name, e.Latest.Version, e.Latest.Status)
+}
+
+// Migrator migrates a helm-classic workflow install to a Helm release.
+type Migrator struct {
+	client kubernetes.Interface
+	opts   Options
+	plan   *Plan
+}
+
+// NewMigrator returns a Migrator for the cluster of client.
+func NewMigrator(client kubernetes.Interface, opts Options) *Migrator {
+	if opts.Namespace == "" {
+		opts.Namespace = "deis"
+	}
+	if opts.TillerNamespace == "" {
+		opts.TillerNamespace = DefaultTillerNamespace
+	}
+	if opts.ReleaseName == "" {
+		opts.ReleaseName = "deis-workflow"
+	}
+	if opts.Version == "" {
+		opts.Version = "v2.7.0"
+	}
+	if opts.Target == "" {
+		opts.Target = TargetHelm2
+	}
+	if opts.Selector == nil {
+		opts.Selector = labels.Set{"heritage": "deis"}.AsSelector()
+	}
+	if opts.HookSecrets == nil {
+		opts.HookSecrets = DefaultHookSecrets
+	}
+	return &Migrator{client: client, opts: opts}
+}
+
+// Plan works out the storage driver and the revision the migration writes. An
+// existing release is refused unless Supersede is set. The plan is kept for
+// Migrate, so the caller can look at it before anything changes.
+func (m *Migrator) Plan() (*Plan, error) {
+	if m.plan != nil {
+		return m.plan, nil
+	}
+	o := m.opts
+	if o.Target != TargetHelm2 && o.Target != TargetHelm3 {
+		return nil, fmt.Errorf("unknown migration target %q, must be %q or %q", o.Target, TargetHelm2, TargetHelm3)
+	}
+	plan := &Plan{Storage: o.Storage, Version: 1}
+	var err error
+	if o.Target == TargetHelm2 {
+		if plan.Storage == "" {
+			plan.Storage, err = DetectTillerStorage(m.client, o.TillerNamespace)
+			if err != nil {
+				return nil, fmt.Errorf("detecting the tiller storage driver: %v", err)
+			}
+		}
+		if plan.Storage != StorageConfigMap && plan.Storage != StorageSecret {
+			return nil, fmt.Errorf("unknown tiller storage driver %q, must be %q or %q", plan.Storage, StorageConfigMap, StorageSecret)
+		}
+		plan.Revisions, err = TillerRevisions(plan.Storage, o.ReleaseName, o.TillerNamespace, m.client)
+	} else {
+		plan.Revisions, err = Helm3Revisions(o.ReleaseName, o.Namespace, m.client)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing existing revisions of %s: %v", o.ReleaseName, err)
+	}
+	if len(plan.Revisions) > 0 {
+		latest := plan.Revisions[len(plan.Revisions)-1]
+		if !o.Supersede {
+			return nil, &ReleaseExistsError{Name: o.ReleaseName, Latest: latest}
+		}
+		plan.Version = latest.Version + 1
+	}
+	m.plan = plan
+	return plan, nil
+}
+
+// Migrate writes the release for the install. It reads the values, backs up and
+// updates the secrets they rely on, annotates the hook secrets, protects the
+// stateful objects, builds the release, deletes the DeletedDeployments once the
+// release key is known to be free and stores the release, superseding the
+// deployed revisions. Nothing is changed before the values are
+// read, so a failure up to then leaves the install untouched. The client calls
+// can't be cancelled, so ctx is checked between steps. Locking, the database
+// backup and health checks are left to the caller. On failure the result holds
+// what was done so far.
+func (m *Migrator) Migrate(ctx context.Context) (*Result, error) {
+	o := m.opts
+	if !o.DryRun && o.Hooks.Backup == nil {
+		return nil, errors.New("refusing to change the cluster without a backup hook")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	plan, err := m.Plan()
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Plan: plan}
+
+	if len(o.Params) > 0 {
+		result.Values, result.Mutations, result.Disagreements, result.UnknownParams, err = ReadValuesFromParams(m.client, o.Namespace, o.Params)
+	} else {
+		result.Values, result.Mutations, err = ReadValues(m.client, o.Namespace)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading values: %v", err)
+	}
+	result.RawValues, err = result.Values.Render()
+	if err != nil {
+		return nil, fmt.Errorf("rendering values: %v", err)
+	}
+	if err := m.afterStep(ctx, StepValues, result); err != nil {
+		return result, err
+	}
+	if o.DryRun {
+		return result, m.buildRelease(ctx, result)
+	}
+
+	// every secret that is changed is backed up before the first change
+	backupSecrets := append([]string{}, o.HookSecrets...)
+	for _, mutation := range result.Mutations {
+		backupSecrets = append(backupSecrets, mutation.Name)
+	}
+	backedUp := make(map[string]struct{})
+	for _, name := range backupSecrets {
+		if _, ok := backedUp[name]; ok {
+			continue
+		}
+		backedUp[name] = struct{}{}
+		secret, err := m.client.Core().Secrets(o.Namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("backing up secret %s: %v", name, err)
+		}
+		secret.Kind = "Secret"
+		secret.APIVersion = "v1"
+		if err := o.Hooks.Backup("Secret", name, secret); err != nil {
+			return result, fmt.Errorf("backing up secret %s: %v", name, err)
+		}
+	}
+	if err := ApplySecretMutations(m.client, o.Namespace, result.Mutations); err != nil {
+		return result, err
+	}
+	if err := m.afterStep(ctx, StepSecrets, result); err != nil {
+		return result, err
+	}
+
+	// The hashes let `verify` confirm after the upgrade that the secrets kept their
+	// data, so they are taken once the secrets hold what the new charts expect. A
+	// secret that isn't annotated would be regenerated by the upgrade, so nothing is
+	// deleted unless all of them are.
+	hashes, err := SecretHashes(m.client, o.Namespace, o.HookSecrets)
+	if err != nil {
+		return result, fmt.Errorf("hashing secrets: %v", err)
+	}
+	result.Secrets, err = UpdateSecrets(m.client, o.Namespace, o.HookSecrets)
+	if err != nil {
+		return result, err
+	}
+	if err := SaveSecretHashes(m.client, o.Namespace, hashes); err != nil {
+		return result, fmt.Errorf("saving secret hashes: %v", err)
+	}
+	if err := m.afterStep(ctx, StepAnnotate, result); err != nil {
+		return result, err
+	}
+
+	if err := ProtectObjects(m.client, o.Protected); err != nil {
+		return result, err
+	}
+	if err := m.afterStep(ctx, StepProtect, result); err != nil {
+		return result, err
+	}
+
+	// The release is built and its key checked before anything is deleted, so that
+	// a manifest that can't be captured or a release written in the meantime stops
+	// the migration while the deployments are still running.
+	if err := m.buildRelease(ctx, result); err != nil {
+		return result, err
+	}
+	if err := m.checkKeyFree(result.Key); err != nil {
+		return result, err
+	}
+
+	// Deployments are deleted because patching them fails on clusters before 1.4.4
+	// (https://github.com/kubernetes/kubernetes/pull/35071).
+	result.Deleted, err = DeleteDeployments(m.client, o.Namespace, func(name string, obj Object) error {
+		return o.Hooks.Backup("Deployment", name, obj)
+	})
+	if err != nil {
+		return result, fmt.Errorf("deleting deployments: %v", err)
+	}
+	if err := m.afterStep(ctx, StepDelete, result); err != nil {
+		return result, err
+	}
+
+	if o.Target == TargetHelm3 {
+		if err := AdoptObjects(m.client, ManifestRefs(result.Objects, o.Namespace), o.ReleaseName, o.Namespace); err != nil {
+			return result, fmt.Errorf("adopting objects: %v", err)
+		}
+		err = Helm3Create(result.Release, m.client)
+	} else {
+		err = TillerCreate(plan.Storage, result.Key, result.Release, o.TillerNamespace, m.client)
+	}
+	if err != nil {
+		return result, fmt.Errorf("creating release %s: %v", result.Key, err)
+	}
+	if err := m.afterStep(ctx, StepRelease, result); err != nil {
+		return result, err
+	}
+
+	// the previous revisions are only superseded once the new one is stored so that
+	// a failure leaves the release with a deployed revision
+	for _, rev := range plan.Deployed() {
+		if o.Target == TargetHelm3 {
+			err = Helm3Supersede(rev, o.Namespace, m.client)
+		} else {
+			err = TillerSupersede(plan.Storage, rev, o.TillerNamespace, m.client)
+		}
+		if err != nil {
+			return result, fmt.Errorf("superseding %s: %v", rev.Key, err)
+		}
+		result.Superseded = append(result.Superseded, rev)
+	}
+	return result, m.afterStep(ctx, StepSupersede, result)
+}
+
+// buildRelease builds the manifest and the release. The DeletedDeployments are
+// left out wherever the manifest comes from, so that the upgrade creates them
+// instead of patching objects that no longer exist. With Helm 3 as the target every
+// object carries the ownership metadata, otherwise Helm 3 refuses to upgrade
+// objects it didn't create. Protected objects carry the resource policy in the
+// manifest too, which is where helm looks for it on delete.
+func (m *Migrator) buildRelease(ctx context.Context, result *Result) error {
+	o := m.opts
+	var objs []ManifestObject
+	if o.ManifestFiles != nil {
+		objs = ManifestFromFiles(o.ManifestFiles, o.Namespace, o.HookSecrets, o.APIVersions, o.TemplatePaths)
+	} else {
+		var err error
+		objs, err = CaptureManifest(m.client, o.Namespace, o.Selector, o.HookSecrets, o.APIVersions)
+		if err != nil {
+			return fmt.Errorf("capturing the manifest: %v", err)
+		}
+	}
+	deleted := make(map[ObjectRef]struct{})
+	for _, name := range DeletedDeployments {
+		deleted[ObjectRef{Kind: "Deployment", Namespace: o.Namespace, Name: name}] = struct{}{}
+	}
+	protected := make(map[ObjectRef]struct{})
+	for _, obj := range o.Protected {
+		protected[obj] = struct{}{}
+	}
+	result.Objects = nil
+	for _, obj := range objs {
+		if _, ok := deleted[obj.Object.Ref(o.Namespace)]; !ok {
+			result.Objects = append(result.Objects, obj)
+		}
+	}
+	err := StampObjects(result.Objects, func(kind string, objMeta *v1.ObjectMeta) {
+		if o.Target == TargetHelm3 {
+			Helm3Adopt(objMeta, o.ReleaseName, o.Namespace)
+		}
+		if _, ok := protected[ObjectRef{Kind: kind, Namespace: o.Namespace, Name: objMeta.Name}]; ok {
+			Protect(objMeta)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	result.Manifest, err = RenderManifest(result.Objects)
+	if err != nil {
+		return err
+	}
+	result.Release = NewRelease(o.ReleaseName, o.Namespace, result.Plan.Version, o.Version, result.RawValues, result.Manifest)
+	if o.Target == TargetHelm3 {
+		result.Key = Helm3SecretName(o.ReleaseName, result.Plan.Version)
+	} else {
+		result.Key = fmt.Sprintf("%s.v%d", o.ReleaseName, result.Plan.Version)
+	}
+	return m.afterStep(ctx, StepManifest, result)
+}
+
+// checkKeyFree returns an error if the storage for the release already holds key.
+func (m *Migrator) checkKeyFree(key string) error {
+	o := m.opts
+	var err error
+	switch {
+	case o.Target == TargetHelm3:
+		_, err = m.client.Core().Secrets(o.Namespace).Get(key)
+	case m.plan.Storage == StorageSecret:
+		_, err = m.client.Core().Secrets(o.TillerNamespace).Get(key)
+	default:
+		_, err = m.client.Core().ConfigMaps(o.TillerNamespace).Get(key)
+	}
+	if err == nil {
+		return fmt.Errorf("release %s already exists", key)
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("checking release %s: %v", key, err)
+	}
+	return nil
+}
+
+func (m *Migrator) afterStep(ctx context.Context, step string, result *Result) error {
+	if m.opts.Hooks.AfterStep != nil {
+		if err := m.opts.Hooks.AfterStep(step, result); err != nil {
+			return fmt.Errorf("after %s: %v", step, err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("stopped after %s: %v", step, err)
+	}
+	return nil
+}
+
+// NewRelease returns the deployed release of the workflow chart at version with
+// the given values and manifest.
+func NewRelease(name, namespace string, version int32, workflowVersion, raw, manifest string) *rspb.Release {
+	ts := timeconv.Now()
+	config := &chart.Config{Raw: raw}
+	return &rspb.Release{
+		Name:      name,
+		Namespace: namespace,
+		Version:   version,
+		Config:    config,
+		Chart:     &chart.Chart{Metadata: &chart.Metadata{Name: "workflow", Version: workflowVersion}, Values: config},
+		Info: &rspb.Info{
+			FirstDeployed: ts,
+			LastDeployed:  ts,
+			Status:        &rspb.Status{Code: rspb.Status_DEPLOYED},
+		},
+		Manifest: manifest,
+	}
+}
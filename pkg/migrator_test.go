@@ -0,0 +1,248 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+)
+
+// addWorkflow seeds s with a small helm-classic install using off-cluster postgres
+// and s3, and with a Tiller using configmaps.
+func addWorkflow(t *testing.T, s *testServer) {
+	s.discover("extensions/v1beta1", "Deployment", "DaemonSet", "ReplicaSet")
+	heritage := map[string]string{"heritage": "deis"}
+	container := func(env ...v1.EnvVar) v1.PodTemplateSpec {
+		return v1.PodTemplateSpec{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "main", Image: "quay.io/deis/main:v2.7.0", Env: env}}}}
+	}
+	deployment := func(name string, template v1.PodTemplateSpec) *v1beta1.Deployment {
+		return &v1beta1.Deployment{ObjectMeta: v1.ObjectMeta{Name: name, Labels: heritage}, Spec: v1beta1.DeploymentSpec{Template: template}}
+	}
+
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "objectstorage-keyfile", Labels: heritage, Annotations: map[string]string{"deis.io/objectstorage": "s3"}},
+		Data:       map[string][]byte{"accesskey": []byte("AKIAEXAMPLE"), "region": []byte("us-west-2")},
+	})
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "database-creds", Labels: heritage},
+		Data:       map[string][]byte{"user": []byte("deis"), "password": []byte("postgres")},
+	})
+	s.add(t, "/api/v1/namespaces/deis/services", &v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-router", Labels: heritage},
+		Spec:       v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Port: 80}}},
+	})
+	deployments := []*v1beta1.Deployment{
+		deployment("deis-controller", container(
+			v1.EnvVar{Name: "DEIS_DATABASE_NAME", Value: "deis"},
+			v1.EnvVar{Name: "DEIS_DATABASE_SERVICE_HOST", Value: "db.example.com"},
+			v1.EnvVar{Name: "DEIS_DATABASE_SERVICE_PORT", Value: "5432"},
+		)),
+		deployment("deis-logger", container()),
+		deployment("deis-monitor-grafana", container()),
+		deployment("deis-router", container()),
+	}
+	for _, d := range deployments {
+		s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", d)
+	}
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/daemonsets", &v1beta1.DaemonSet{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-monitor-telegraf", Labels: heritage},
+		Spec:       v1beta1.DaemonSetSpec{Template: container()},
+	})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/kube-system/deployments", &v1beta1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "tiller-deploy"},
+		Spec:       v1beta1.DeploymentSpec{Template: container()},
+	})
+}
+
+// changes returns the requests made to s that aren't reads.
+func changes(s *testServer) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var changed []string
+	for _, r := range s.requests {
+		if !strings.HasPrefix(r, "GET ") {
+			changed = append(changed, r)
+		}
+	}
+	return changed
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addWorkflow(t, s)
+
+	var steps []string
+	m := NewMigrator(clientset, Options{
+		DryRun: true,
+		Hooks: Hooks{AfterStep: func(step string, result *Result) error {
+			steps = append(steps, step)
+			return nil
+		}},
+	})
+	result, err := m.Migrate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed := changes(s); len(changed) > 0 {
+		t.Errorf("a dry run changed the cluster: %v", changed)
+	}
+	if want := []string{StepValues, StepManifest}; strings.Join(steps, ",") != strings.Join(want, ",") {
+		t.Errorf("got steps %q, want %q", steps, want)
+	}
+	if result.Plan.Storage != StorageConfigMap || result.Key != "deis-workflow.v1" || result.Release.Version != 1 {
+		t.Errorf("got %s release %s revision %d", result.Plan.Storage, result.Key, result.Release.Version)
+	}
+	if len(result.Mutations) != 1 || result.Mutations[0].Name != "database-creds" {
+		t.Errorf("got mutations %v, want database-creds", result.Mutations)
+	}
+	if !strings.Contains(result.RawValues, "db.example.com") {
+		t.Errorf("values don't carry the off-cluster database:\n%s", result.RawValues)
+	}
+	for _, want := range []string{"name: deis-router", "name: objectstorage-keyfile"} {
+		if !strings.Contains(result.Manifest, want) {
+			t.Errorf("manifest lacks %q:\n%s", want, result.Manifest)
+		}
+	}
+	for _, obj := range result.Objects {
+		if ref := obj.Object.Ref("deis"); ref.Kind == "Deployment" && ref.Name == "deis-controller" {
+			t.Error("the manifest holds deis-controller, which the migration deletes")
+		}
+		if ref := obj.Object.Ref("deis"); ref.Kind == "Secret" && ref.Name == "database-creds" {
+			t.Error("the manifest holds the hook secret database-creds")
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addWorkflow(t, s)
+	deployments := "/apis/extensions/v1beta1/namespaces/deis/deployments/deis-controller"
+
+	var steps []string
+	backups := make(map[string]bool)
+	m := NewMigrator(clientset, Options{
+		Hooks: Hooks{
+			Backup: func(kind, name string, obj interface{}) error {
+				backups[kind+" "+name] = true
+				return nil
+			},
+			AfterStep: func(step string, result *Result) error {
+				steps = append(steps, step)
+				if step == StepManifest && s.count("DELETE", deployments) > 0 {
+					t.Error("deis-controller was deleted before the release was built")
+				}
+				return nil
+			},
+		},
+	})
+	result, err := m.Migrate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{StepValues, StepSecrets, StepAnnotate, StepProtect, StepManifest, StepDelete, StepRelease, StepSupersede}
+	if strings.Join(steps, ",") != strings.Join(want, ",") {
+		t.Errorf("got steps %q, want %q", steps, want)
+	}
+	if s.get(deployments) != nil || !backups["Deployment deis-controller"] {
+		t.Errorf("deis-controller wasn't backed up and deleted, backups %v", backups)
+	}
+	if !backups["Secret database-creds"] {
+		t.Errorf("database-creds wasn't backed up before it was changed, backups %v", backups)
+	}
+	if s.get("/api/v1/namespaces/kube-system/configmaps/"+result.Key) == nil {
+		t.Errorf("release %s wasn't stored", result.Key)
+	}
+}
+
+func TestMigrateKeyTaken(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addWorkflow(t, s)
+
+	m := NewMigrator(clientset, Options{
+		Hooks: Hooks{
+			Backup: func(kind, name string, obj interface{}) error { return nil },
+			AfterStep: func(step string, result *Result) error {
+				if step == StepManifest {
+					// another run stores the release once the plan is made
+					s.add(t, "/api/v1/namespaces/kube-system/configmaps", &v1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: result.Key}})
+				}
+				return nil
+			},
+		},
+	})
+	if _, err := m.Migrate(context.Background()); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("got %v, want the release to exist", err)
+	}
+	if n := s.count("DELETE", "/apis/extensions/v1beta1/namespaces/deis/deployments/deis-controller"); n > 0 {
+		t.Error("deis-controller was deleted although the release couldn't be stored")
+	}
+}
+
+func TestMigrateRequiresBackup(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addWorkflow(t, s)
+
+	if _, err := NewMigrator(clientset, Options{}).Migrate(context.Background()); err == nil {
+		t.Error("expected a migration without a backup hook to be refused")
+	}
+	if changed := changes(s); len(changed) > 0 {
+		t.Errorf("a refused migration changed the cluster: %v", changed)
+	}
+}
+
+func TestMigrateStopsWhenCancelled(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addWorkflow(t, s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var steps []string
+	m := NewMigrator(clientset, Options{
+		Hooks: Hooks{
+			Backup: func(kind, name string, obj interface{}) error { return nil },
+			AfterStep: func(step string, result *Result) error {
+				steps = append(steps, step)
+				// the lease is lost while the values are read
+				cancel()
+				return nil
+			},
+		},
+	})
+	if _, err := m.Migrate(ctx); err == nil {
+		t.Error("expected a cancelled migration to fail")
+	}
+	if want := []string{StepValues}; strings.Join(steps, ",") != strings.Join(want, ",") {
+		t.Errorf("got steps %q, want %q", steps, want)
+	}
+	if changed := changes(s); len(changed) > 0 {
+		t.Errorf("a cancelled migration changed the cluster: %v", changed)
+	}
+}
+
+func TestPlanExistingRelease(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	addWorkflow(t, s)
+	if err := TillerCreate(StorageConfigMap, "deis-workflow.v1", testRelease(1), DefaultTillerNamespace, clientset); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewMigrator(clientset, Options{}).Plan()
+	if _, ok := err.(*ReleaseExistsError); !ok {
+		t.Errorf("got %v, want a ReleaseExistsError", err)
+	}
+	plan, err := NewMigrator(clientset, Options{Supersede: true}).Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Version != 2 || len(plan.Deployed()) != 1 {
+		t.Errorf("got revision %d superseding %v, want revision 2 superseding v1", plan.Version, plan.Deployed())
+	}
+}
@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/client-go/1.5/kubernetes"
+)
+
+// SecretMutation is a change to the data of a secret that brings it in line with
+// the secret templates of the new charts. `helm upgrade` doesn't touch these
+// secrets since they are pre-install hooks, so the migration has to.
+type SecretMutation struct {
+	Name string
+	Data map[string]string
+}
+
+func (m SecretMutation) String() string {
+	keys := make([]string, 0, len(m.Data))
+	for key := range m.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("secret %s: set %s", m.Name, strings.Join(keys, ", "))
+}
+
+// ApplySecretMutations sets the data of each mutation on its secret. Every attempt
+// reads the secret afresh and the update carries its resource version, so a
+// concurrent change makes the update conflict and be retried rather than lost.
+func ApplySecretMutations(kubeClient kubernetes.Interface, namespace string, mutations []SecretMutation) error {
+	for _, m := range mutations {
+		attempts, err := retry(retryAttempts, retryWait, func() error {
+			secret, err := kubeClient.Core().Secrets(namespace).Get(m.Name)
+			if err != nil {
+				return err
+			}
+			if secret.Data == nil {
+				secret.Data = make(map[string][]byte)
+			}
+			for key, value := range m.Data {
+				secret.Data[key] = []byte(value)
+			}
+			_, err = kubeClient.Core().Secrets(namespace).Update(secret)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s failed after %d attempt(s): %v", m, attempts, err)
+		}
+	}
+	return nil
+}
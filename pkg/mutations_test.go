@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+func TestApplySecretMutationsRetriesConflicts(t *testing.T) {
+	defer func(wait time.Duration) { retryWait = wait }(retryWait)
+	retryWait = time.Millisecond
+
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "objectstorage-keyfile"},
+		Data:       map[string][]byte{"accesskey": []byte("key")},
+	})
+	const path = "/api/v1/namespaces/deis/secrets/objectstorage-keyfile"
+	s.failNext("PUT", path, apierrors.NewConflict(secretsResource, "objectstorage-keyfile", errors.New("changed")))
+
+	mutations := []SecretMutation{{Name: "objectstorage-keyfile", Data: map[string]string{"secretkey": "secret"}}}
+	if err := ApplySecretMutations(clientset, "deis", mutations); err != nil {
+		t.Fatal(err)
+	}
+	if gets, puts := s.count("GET", path), s.count("PUT", path); gets != 2 || puts != 2 {
+		t.Errorf("got %d reads and %d updates, want the secret read afresh for each of 2 attempts", gets, puts)
+	}
+	data := mapField(s.get(path), "data")
+	want := map[string]string{"accesskey": "key", "secretkey": "secret"}
+	for key, value := range want {
+		if data[key] != base64.StdEncoding.EncodeToString([]byte(value)) {
+			t.Errorf("data[%s] = %v, want %q encoded", key, data[key], value)
+		}
+	}
+
+	s.failNext("PUT", path, apierrors.NewForbidden(secretsResource, "objectstorage-keyfile", errors.New("denied")))
+	err := ApplySecretMutations(clientset, "deis", mutations)
+	if err == nil || !strings.Contains(err.Error(), "secret objectstorage-keyfile: set secretkey failed after 1 attempt(s)") {
+		t.Errorf("got %v, want the forbidden update reported after 1 attempt", err)
+	}
+}
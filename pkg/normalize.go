@@ -0,0 +1,262 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// Annotations the server and kubectl keep on the objects they manage.
+var serverAnnotations = []string{
+	"deployment.kubernetes.io/revision",
+	"deprecated.daemonset.template.generation",
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// Metadata fields the server populates. Owner references point at objects by uid,
+// which a recreated object doesn't share.
+var serverMetadata = []string{"uid", "selfLink", "creationTimestamp", "generation", "resourceVersion", "managedFields", "ownerReferences"}
+
+// deploymentDefaults are the fields the server fills into a deployment spec, by
+// apiVersion.
+var deploymentDefaults = map[string]struct {
+	maxUnavailable, maxSurge interface{}
+	revisionHistoryLimit     float64
+	progressDeadlineSeconds  float64
+}{
+	"extensions/v1beta1": {float64(1), float64(1), 2147483647, 2147483647},
+	"apps/v1beta1":       {"25%", "25%", 2, 600},
+	"apps/v1beta2":       {"25%", "25%", 10, 600},
+	"apps/v1":            {"25%", "25%", 10, 600},
+}
+
+// ToObject converts a typed object to an Object.
+func ToObject(v interface{}) (Object, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	obj := Object{}
+	err = json.Unmarshal(b, &obj)
+	return obj, err
+}
+
+// Normalize strips what the server added to a captured object: the status, the
+// metadata it populates, and the fields that hold the API defaults. What remains
+// reads like the chart output the object would be rendered from, so that the three
+// way merge of the next upgrade only patches what the charts actually change. The
+// defaults are looked up by the object's apiVersion, which has to be the version
+// it was read in.
+func Normalize(obj Object) {
+	delete(obj, "status")
+	normalizeMeta(child(obj, "metadata"))
+	spec := child(obj, "spec")
+	if spec == nil {
+		if obj.Kind() == "Secret" {
+			dropIfEqual(obj, "type", "Opaque")
+		}
+		return
+	}
+	apiVersion, _ := obj["apiVersion"].(string)
+	switch obj.Kind() {
+	case "Deployment":
+		normalizeDeployment(spec, apiVersion)
+		normalizePodTemplate(child(spec, "template"))
+	case "DaemonSet":
+		normalizeDaemonSet(spec, apiVersion)
+		normalizePodTemplate(child(spec, "template"))
+	case "ReplicationController":
+		dropIfEqual(spec, "replicas", float64(1))
+		normalizePodTemplate(child(spec, "template"))
+	case "Service":
+		normalizeService(spec)
+	}
+}
+
+func normalizeMeta(meta map[string]interface{}) {
+	if meta == nil {
+		return
+	}
+	for _, key := range serverMetadata {
+		delete(meta, key)
+	}
+	if annotations := child(meta, "annotations"); annotations != nil {
+		for _, key := range serverAnnotations {
+			delete(annotations, key)
+		}
+	}
+	dropIfEmpty(meta, "annotations")
+	dropIfEmpty(meta, "labels")
+}
+
+func normalizeDeployment(spec map[string]interface{}, apiVersion string) {
+	dropIfEqual(spec, "replicas", float64(1))
+	defaults, ok := deploymentDefaults[apiVersion]
+	if !ok {
+		return
+	}
+	dropIfEqual(spec, "revisionHistoryLimit", defaults.revisionHistoryLimit)
+	dropIfEqual(spec, "progressDeadlineSeconds", defaults.progressDeadlineSeconds)
+	if strategy := child(spec, "strategy"); strategy != nil && strategy["type"] == "RollingUpdate" {
+		if rollingUpdate := child(strategy, "rollingUpdate"); rollingUpdate != nil {
+			dropIfEqual(rollingUpdate, "maxUnavailable", defaults.maxUnavailable)
+			dropIfEqual(rollingUpdate, "maxSurge", defaults.maxSurge)
+			dropIfEmpty(strategy, "rollingUpdate")
+		}
+		if len(strategy) == 1 {
+			delete(spec, "strategy")
+		}
+	}
+}
+
+func normalizeDaemonSet(spec map[string]interface{}, apiVersion string) {
+	delete(spec, "templateGeneration")
+	strategy := child(spec, "updateStrategy")
+	if strings.HasPrefix(apiVersion, "extensions/") {
+		if strategy != nil && strategy["type"] == "OnDelete" {
+			delete(spec, "updateStrategy")
+		}
+		return
+	}
+	dropIfEqual(spec, "revisionHistoryLimit", float64(10))
+	if strategy != nil && strategy["type"] == "RollingUpdate" {
+		if rollingUpdate := child(strategy, "rollingUpdate"); rollingUpdate != nil {
+			dropIfEqual(rollingUpdate, "maxUnavailable", float64(1))
+			dropIfEmpty(strategy, "rollingUpdate")
+		}
+		if len(strategy) == 1 {
+			delete(spec, "updateStrategy")
+		}
+	}
+}
+
+func normalizePodTemplate(template map[string]interface{}) {
+	if template == nil {
+		return
+	}
+	normalizeMeta(child(template, "metadata"))
+	dropIfEmpty(template, "metadata")
+	spec := child(template, "spec")
+	if spec == nil {
+		return
+	}
+	dropIfEqual(spec, "restartPolicy", "Always")
+	dropIfEqual(spec, "dnsPolicy", "ClusterFirst")
+	dropIfEqual(spec, "terminationGracePeriodSeconds", float64(30))
+	dropIfEqual(spec, "schedulerName", "default-scheduler")
+	dropIfEqual(spec, "serviceAccount", spec["serviceAccountName"])
+	dropIfEmpty(spec, "securityContext")
+	for _, key := range []string{"containers", "initContainers"} {
+		for _, container := range children(spec, key) {
+			normalizeContainer(container)
+		}
+	}
+	for _, volume := range children(spec, "volumes") {
+		for _, source := range []string{"secret", "configMap"} {
+			if s := child(volume, source); s != nil {
+				dropIfEqual(s, "defaultMode", float64(0644))
+			}
+		}
+	}
+}
+
+func normalizeContainer(container map[string]interface{}) {
+	dropIfEqual(container, "terminationMessagePath", "/dev/termination-log")
+	dropIfEqual(container, "terminationMessagePolicy", "File")
+	if image, ok := container["image"].(string); ok {
+		dropIfEqual(container, "imagePullPolicy", defaultPullPolicy(image))
+	}
+	dropIfEmpty(container, "resources")
+	for _, port := range children(container, "ports") {
+		dropIfEqual(port, "protocol", "TCP")
+	}
+	for _, key := range []string{"livenessProbe", "readinessProbe"} {
+		probe := child(container, key)
+		if probe == nil {
+			continue
+		}
+		dropIfEqual(probe, "timeoutSeconds", float64(1))
+		dropIfEqual(probe, "periodSeconds", float64(10))
+		dropIfEqual(probe, "successThreshold", float64(1))
+		dropIfEqual(probe, "failureThreshold", float64(3))
+		if httpGet := child(probe, "httpGet"); httpGet != nil {
+			dropIfEqual(httpGet, "scheme", "HTTP")
+		}
+	}
+	for _, env := range children(container, "env") {
+		if fieldRef := child(child(env, "valueFrom"), "fieldRef"); fieldRef != nil {
+			dropIfEqual(fieldRef, "apiVersion", "v1")
+		}
+	}
+}
+
+func normalizeService(spec map[string]interface{}) {
+	// headless services keep their clusterIP, any other is allocated by the server
+	if spec["clusterIP"] != "None" {
+		delete(spec, "clusterIP")
+	}
+	dropIfEqual(spec, "sessionAffinity", "None")
+	dropIfEqual(spec, "type", "ClusterIP")
+	dropIfEqual(spec, "externalTrafficPolicy", "Cluster")
+	for _, port := range children(spec, "ports") {
+		dropIfEqual(port, "protocol", "TCP")
+		dropIfEqual(port, "targetPort", port["port"])
+	}
+}
+
+// defaultPullPolicy is the pull policy the server sets for image: Always for the
+// latest tag or no tag at all, IfNotPresent otherwise.
+func defaultPullPolicy(image string) string {
+	if strings.Contains(image, "@") {
+		return "IfNotPresent"
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 && name[i+1:] != "latest" {
+		return "IfNotPresent"
+	}
+	return "Always"
+}
+
+func child(m map[string]interface{}, key string) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	c, _ := m[key].(map[string]interface{})
+	return c
+}
+
+func children(m map[string]interface{}, key string) []map[string]interface{} {
+	list, _ := m[key].([]interface{})
+	var c []map[string]interface{}
+	for _, item := range list {
+		if item, ok := item.(map[string]interface{}); ok {
+			c = append(c, item)
+		}
+	}
+	return c
+}
+
+func dropIfEqual(m map[string]interface{}, key string, value interface{}) {
+	if v, ok := m[key]; ok && value != nil && reflect.DeepEqual(v, value) {
+		delete(m, key)
+	}
+}
+
+func dropIfEmpty(m map[string]interface{}, key string) {
+	v, ok := m[key]
+	if !ok {
+		return
+	}
+	switch v := v.(type) {
+	case nil:
+		delete(m, key)
+	case map[string]interface{}:
+		if len(v) == 0 {
+			delete(m, key)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			delete(m, key)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ghodss/yaml"
+)
+
+func parseObject(t *testing.T, doc string) Object {
+	obj := Object{}
+	if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+		t.Fatalf("parsing %q: %v", doc, err)
+	}
+	return obj
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name, captured, want string
+	}{
+		{
+			name: "deployment in extensions/v1beta1",
+			captured: `
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-router
+  namespace: deis
+  uid: 3c5a4a2e-c4a1-11e6-9c5a-42010a800002
+  selfLink: /apis/extensions/v1beta1/namespaces/deis/deployments/deis-router
+  resourceVersion: "1234"
+  generation: 3
+  creationTimestamp: 2016-12-18T00:00:00Z
+  labels:
+    heritage: deis
+  annotations:
+    deployment.kubernetes.io/revision: "2"
+    kubectl.kubernetes.io/last-applied-configuration: "{}"
+  ownerReferences:
+  - kind: Workflow
+    name: deis
+    uid: 1d2b3c4d
+spec:
+  replicas: 1
+  revisionHistoryLimit: 2147483647
+  strategy:
+    type: RollingUpdate
+    rollingUpdate:
+      maxUnavailable: 1
+      maxSurge: 1
+  template:
+    metadata:
+      labels:
+        app: deis-router
+    spec:
+      restartPolicy: Always
+      dnsPolicy: ClusterFirst
+      terminationGracePeriodSeconds: 30
+      serviceAccount: deis-router
+      serviceAccountName: deis-router
+      securityContext: {}
+      containers:
+      - name: deis-router
+        image: quay.io/deis/router:v2.7.0
+        imagePullPolicy: IfNotPresent
+        terminationMessagePath: /dev/termination-log
+        resources: {}
+        ports:
+        - containerPort: 8080
+          protocol: TCP
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: 9090
+            scheme: HTTP
+          timeoutSeconds: 1
+          periodSeconds: 10
+          successThreshold: 1
+          failureThreshold: 3
+status:
+  replicas: 1
+`,
+			want: `
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-router
+  namespace: deis
+  labels:
+    heritage: deis
+spec:
+  template:
+    metadata:
+      labels:
+        app: deis-router
+    spec:
+      serviceAccountName: deis-router
+      containers:
+      - name: deis-router
+        image: quay.io/deis/router:v2.7.0
+        ports:
+        - containerPort: 8080
+        livenessProbe:
+          httpGet:
+            path: /healthz
+            port: 9090
+`,
+		},
+		{
+			name: "deployment in apps/v1 keeps what differs from the defaults",
+			captured: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deis-builder
+spec:
+  replicas: 2
+  revisionHistoryLimit: 10
+  progressDeadlineSeconds: 600
+  strategy:
+    type: RollingUpdate
+    rollingUpdate:
+      maxUnavailable: 25%
+      maxSurge: 1
+  template:
+    spec:
+      containers:
+      - name: deis-builder
+        image: quay.io/deis/builder:latest
+        imagePullPolicy: Always
+`,
+			want: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: deis-builder
+spec:
+  replicas: 2
+  strategy:
+    type: RollingUpdate
+    rollingUpdate:
+      maxSurge: 1
+  template:
+    spec:
+      containers:
+      - name: deis-builder
+        image: quay.io/deis/builder:latest
+`,
+		},
+		{
+			name: "service",
+			captured: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-controller
+spec:
+  clusterIP: 10.0.0.12
+  type: ClusterIP
+  sessionAffinity: None
+  ports:
+  - port: 80
+    targetPort: 80
+    protocol: TCP
+`,
+			want: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-controller
+spec:
+  ports:
+  - port: 80
+`,
+		},
+		{
+			name: "headless service keeps its cluster IP",
+			captured: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-database
+spec:
+  clusterIP: None
+  type: LoadBalancer
+  ports:
+  - port: 5432
+    targetPort: postgres
+`,
+			want: `
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-database
+spec:
+  clusterIP: None
+  type: LoadBalancer
+  ports:
+  - port: 5432
+    targetPort: postgres
+`,
+		},
+		{
+			name: "opaque secret",
+			captured: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: objectstorage-keyfile
+  labels: {}
+type: Opaque
+data:
+  accesskey: YWNjZXNz
+`,
+			want: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: objectstorage-keyfile
+data:
+  accesskey: YWNjZXNz
+`,
+		},
+	}
+	for _, test := range tests {
+		obj := parseObject(t, test.captured)
+		Normalize(obj)
+		if want := parseObject(t, test.want); !reflect.DeepEqual(obj, want) {
+			got, _ := yaml.Marshal(obj)
+			t.Errorf("%s: got\n%s", test.name, got)
+		}
+	}
+}
+
+func TestDefaultPullPolicy(t *testing.T) {
+	tests := map[string]string{
+		"quay.io/deis/router":                 "Always",
+		"quay.io/deis/router:latest":          "Always",
+		"quay.io/deis/router:v2.7.0":          "IfNotPresent",
+		"localhost:5000/router":               "Always",
+		"localhost:5000/router:canary":        "IfNotPresent",
+		"quay.io/deis/router@sha256:0123abcd": "IfNotPresent",
+	}
+	for image, want := range tests {
+		if got := defaultPullPolicy(image); got != want {
+			t.Errorf("defaultPullPolicy(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
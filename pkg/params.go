@@ -0,0 +1,339 @@
+package pkg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"k8s.io/client-go/1.5/kubernetes"
+)
+
+// generateParams is the layout of the generate_params.toml of the helm-classic
+// workflow charts: the locations at the top level and a table per section.
+type generateParams struct {
+	Storage             string `toml:"storage"`
+	DatabaseLocation    string `toml:"database_location"`
+	LoggerRedisLocation string `toml:"logger_redis_location"`
+	InfluxDBLocation    string `toml:"influxdb_location"`
+	GrafanaLocation     string `toml:"grafana_location"`
+	RegistryLocation    string `toml:"registry_location"`
+
+	S3 struct {
+		AccessKey      string `toml:"accesskey"`
+		SecretKey      string `toml:"secretkey"`
+		Region         string `toml:"region"`
+		RegistryBucket string `toml:"registry_bucket"`
+		DatabaseBucket string `toml:"database_bucket"`
+		BuilderBucket  string `toml:"builder_bucket"`
+	} `toml:"s3"`
+	GCS struct {
+		KeyJSON        string `toml:"key_json"`
+		RegistryBucket string `toml:"registry_bucket"`
+		DatabaseBucket string `toml:"database_bucket"`
+		BuilderBucket  string `toml:"builder_bucket"`
+	} `toml:"gcs"`
+	Azure struct {
+		AccountName       string `toml:"accountname"`
+		AccountKey        string `toml:"accountkey"`
+		RegistryContainer string `toml:"registry_container"`
+		DatabaseContainer string `toml:"database_container"`
+		BuilderContainer  string `toml:"builder_container"`
+	} `toml:"azure"`
+	Swift struct {
+		UserName          string `toml:"username"`
+		Password          string `toml:"password"`
+		Tenant            string `toml:"tenant"`
+		AuthURL           string `toml:"authurl"`
+		AuthVersion       string `toml:"authversion"`
+		RegistryContainer string `toml:"registry_container"`
+		DatabaseContainer string `toml:"database_container"`
+		BuilderContainer  string `toml:"builder_container"`
+	} `toml:"swift"`
+	Controller struct {
+		AppPullPolicy    string `toml:"app_pull_policy"`
+		RegistrationMode string `toml:"registration_mode"`
+	} `toml:"controller"`
+	Database struct {
+		Name     string `toml:"name"`
+		UserName string `toml:"username"`
+		Password string `toml:"password"`
+		Host     string `toml:"host"`
+		Port     string `toml:"port"`
+	} `toml:"database"`
+	Redis struct {
+		DB       string `toml:"db"`
+		Host     string `toml:"host"`
+		Port     string `toml:"port"`
+		Password string `toml:"password"`
+	} `toml:"redis"`
+	Grafana struct {
+		User     string `toml:"user"`
+		Password string `toml:"password"`
+	} `toml:"grafana"`
+	InfluxDB struct {
+		URL      string `toml:"url"`
+		Database string `toml:"database"`
+		User     string `toml:"user"`
+		Password string `toml:"password"`
+	} `toml:"influxdb"`
+	Registry struct {
+		HostPort     string `toml:"host_port"`
+		SecretPrefix string `toml:"secret_prefix"`
+	} `toml:"registry"`
+	ECR struct {
+		AccessKey  string `toml:"accesskey"`
+		SecretKey  string `toml:"secretkey"`
+		Region     string `toml:"region"`
+		RegistryID string `toml:"registryid"`
+		HostName   string `toml:"hostname"`
+	} `toml:"ecr"`
+	GCR struct {
+		KeyJSON  string `toml:"key_json"`
+		HostName string `toml:"hostname"`
+	} `toml:"gcr"`
+	OffClusterRegistry struct {
+		HostName     string `toml:"hostname"`
+		Organization string `toml:"organization"`
+		UserName     string `toml:"username"`
+		Password     string `toml:"password"`
+	} `toml:"off_cluster_registry"`
+	Router struct {
+		DHParam string `toml:"dhparam"`
+	} `toml:"router"`
+}
+
+// GetValuesFromParams builds the values from a helm-classic generate_params.toml.
+// Whatever the file leaves out is taken from the cluster, as GetValues does. It
+// also returns every value the file and the cluster disagree on, and the keys of
+// the file it doesn't know, whose values are ignored. Like GetValues it changes
+// nothing; the returned mutations follow what the cluster reports.
+func GetValuesFromParams(kubeClient kubernetes.Interface, namespace string, data []byte) (string, []SecretMutation, []string, []string, error) {
+	values, mutations, disagreements, unknown, err := ReadValuesFromParams(kubeClient, namespace, data)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	raw, err := values.Render()
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	return raw, mutations, disagreements, unknown, nil
+}
+
+// ReadValuesFromParams is GetValuesFromParams returning the values unrendered.
+func ReadValuesFromParams(kubeClient kubernetes.Interface, namespace string, data []byte) (*Values, []SecretMutation, []string, []string, error) {
+	file, unknown, err := parseParams(data)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	cluster, err := clusterValues(kubeClient, namespace)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// sections a side doesn't use are left out so that placeholders don't count
+	fromFile := *file
+	fromFile.pruneUnused()
+	fromCluster := *cluster
+	fromCluster.pruneUnused()
+	disagreements := diffValues("", reflect.ValueOf(fromFile), reflect.ValueOf(fromCluster))
+
+	merged := *cluster
+	overlayValues(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(*file))
+	merged.pruneUnused()
+	return &merged, cluster.mutations, disagreements, unknown, nil
+}
+
+// parseParams returns the values of a generate_params.toml along with the keys it
+// doesn't know, e.g. misspelled ones, which would otherwise silently fall back to
+// the cluster.
+func parseParams(data []byte) (*Values, []string, error) {
+	p := generateParams{}
+	md, err := toml.Decode(string(data), &p)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing generate_params.toml: %v", err)
+	}
+	var unknown []string
+	for _, key := range md.Undecoded() {
+		unknown = append(unknown, key.String())
+	}
+	sort.Strings(unknown)
+	return &Values{
+		StorageLocation:       p.Storage,
+		DatabaseLocation:      p.DatabaseLocation,
+		RedisLocation:         p.LoggerRedisLocation,
+		InfluxDBLocation:      p.InfluxDBLocation,
+		GrafanaLocation:       p.GrafanaLocation,
+		RegistryLocation:      p.RegistryLocation,
+		RegistryHostPort:      p.Registry.HostPort,
+		ImagePullSecretPrefix: p.Registry.SecretPrefix,
+		S3: s3{
+			AccessKey:      p.S3.AccessKey,
+			SecretKey:      p.S3.SecretKey,
+			Region:         p.S3.Region,
+			RegistryBucket: p.S3.RegistryBucket,
+			DatabaseBucket: p.S3.DatabaseBucket,
+			BuilderBucket:  p.S3.BuilderBucket,
+		},
+		GCS: gcs{
+			KeyJSON:        p.GCS.KeyJSON,
+			RegistryBucket: p.GCS.RegistryBucket,
+			DatabaseBucket: p.GCS.DatabaseBucket,
+			BuilderBucket:  p.GCS.BuilderBucket,
+		},
+		Azure: azure{
+			AccountName:       p.Azure.AccountName,
+			AccountKey:        p.Azure.AccountKey,
+			RegistryContainer: p.Azure.RegistryContainer,
+			DatabaseContainer: p.Azure.DatabaseContainer,
+			BuilderContainer:  p.Azure.BuilderContainer,
+		},
+		Swift: swift{
+			UserName:          p.Swift.UserName,
+			Password:          p.Swift.Password,
+			Tenant:            p.Swift.Tenant,
+			AuthURL:           p.Swift.AuthURL,
+			AuthVersion:       p.Swift.AuthVersion,
+			RegistryContainer: p.Swift.RegistryContainer,
+			DatabaseContainer: p.Swift.DatabaseContainer,
+			BuilderContainer:  p.Swift.BuilderContainer,
+		},
+		Postgres: postgres{
+			Name:     p.Database.Name,
+			UserName: p.Database.UserName,
+			Password: p.Database.Password,
+			Host:     p.Database.Host,
+			Port:     p.Database.Port,
+		},
+		Controller: controller{
+			AppPullPolicy:    p.Controller.AppPullPolicy,
+			RegistrationMode: p.Controller.RegistrationMode,
+		},
+		Redis: redis{
+			DB:       p.Redis.DB,
+			Host:     p.Redis.Host,
+			Port:     p.Redis.Port,
+			Password: p.Redis.Password,
+		},
+		Grafana: grafana{
+			User:     p.Grafana.User,
+			Password: p.Grafana.Password,
+		},
+		InfluxDB: influxDB{
+			Database: p.InfluxDB.Database,
+			URL:      p.InfluxDB.URL,
+			User:     p.InfluxDB.User,
+			Password: p.InfluxDB.Password,
+		},
+		ECR: ecr{
+			AccessKey:  p.ECR.AccessKey,
+			SecretKey:  p.ECR.SecretKey,
+			Region:     p.ECR.Region,
+			RegistryID: p.ECR.RegistryID,
+			HostName:   p.ECR.HostName,
+		},
+		GCR: gcr{
+			KeyJSON:  p.GCR.KeyJSON,
+			HostName: p.GCR.HostName,
+		},
+		OffClusterRegistry: offClusterRegistry{
+			HostName:     p.OffClusterRegistry.HostName,
+			Organization: p.OffClusterRegistry.Organization,
+			UserName:     p.OffClusterRegistry.UserName,
+			Password:     p.OffClusterRegistry.Password,
+		},
+		Router: router{
+			DHParam: p.Router.DHParam,
+		},
+	}, unknown, nil
+}
+
+// pruneUnused clears the sections the locations don't use. generate_params.toml
+// carries placeholders for every backend, and the values template renders any
+// section that is filled in.
+func (v *Values) pruneUnused() {
+	if v.StorageLocation != "s3" {
+		v.S3 = s3{}
+	}
+	if v.StorageLocation != "gcs" {
+		v.GCS = gcs{}
+	}
+	if v.StorageLocation != "azure" {
+		v.Azure = azure{}
+	}
+	if v.StorageLocation != "swift" {
+		v.Swift = swift{}
+	}
+	if v.DatabaseLocation != offCluster {
+		v.Postgres = postgres{}
+	}
+	if v.RedisLocation != offCluster {
+		v.Redis = redis{}
+	}
+	if v.InfluxDBLocation != offCluster {
+		v.InfluxDB = influxDB{}
+	}
+	if v.RegistryLocation != "ecr" {
+		v.ECR = ecr{}
+	}
+	if v.RegistryLocation != "gcr" {
+		v.GCR = gcr{}
+	}
+	if v.RegistryLocation != offCluster {
+		v.OffClusterRegistry = offClusterRegistry{}
+	}
+}
+
+// overlayValues copies every string the file sets over the cluster's.
+func overlayValues(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		switch field := src.Field(i); field.Kind() {
+		case reflect.String:
+			if field.String() != "" {
+				dst.Field(i).SetString(field.String())
+			}
+		case reflect.Struct:
+			overlayValues(dst.Field(i), field)
+		}
+	}
+}
+
+// diffValues describes every string set on both sides to a different value.
+// Credentials are reported without their values.
+func diffValues(prefix string, file, cluster reflect.Value) []string {
+	var diffs []string
+	for i := 0; i < file.NumField(); i++ {
+		f := file.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := prefix + f.Name
+		switch field := file.Field(i); field.Kind() {
+		case reflect.String:
+			a, b := field.String(), cluster.Field(i).String()
+			if a == "" || b == "" || a == b {
+				continue
+			}
+			if isSecretField(f.Name) {
+				diffs = append(diffs, fmt.Sprintf("%s: generate_params.toml and the cluster differ", name))
+				continue
+			}
+			diffs = append(diffs, fmt.Sprintf("%s: generate_params.toml has %q, the cluster has %q", name, a, b))
+		case reflect.Struct:
+			diffs = append(diffs, diffValues(name+".", field, cluster.Field(i))...)
+		}
+	}
+	return diffs
+}
+
+func isSecretField(name string) bool {
+	for _, s := range []string{"Password", "Key", "JSON"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
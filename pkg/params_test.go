@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+const paramsFile = `
+storage = "s3"
+database_location = "off-cluster"
+logger_redis_location = "on-cluster"
+registry_location = "ecr"
+influxdb_locaton = "off-cluster"
+
+[s3]
+accesskey = "AKIAEXAMPLE"
+secretkey = "secret"
+region = "us-west-2"
+registry_bucket = "deis-registry"
+database_bucket = "deis-database"
+builder_bucket = "deis-builder"
+
+[gcs]
+key_json = "<base64-encoded JSON data>"
+registry_bucket = "your-registry-bucket-name"
+
+[database]
+name = "deis"
+username = "deis"
+password = "postgres"
+host = "db.example.com"
+port = "5432"
+
+[ecr]
+region = "us-west-2"
+registryid = "123456789012"
+hostname = "123456789012.dkr.ecr.us-west-2.amazonaws.com"
+
+[controller]
+app_pull_policy = "Always"
+registation_mode = "admin_only"
+
+[registry]
+host_port = "5555"
+`
+
+func TestParseParams(t *testing.T) {
+	values, unknown, err := parseParams([]byte(paramsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"controller.registation_mode", "influxdb_locaton"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("got unknown keys %v, want %v", unknown, want)
+	}
+	want := Values{
+		StorageLocation:  "s3",
+		DatabaseLocation: "off-cluster",
+		RedisLocation:    "on-cluster",
+		RegistryLocation: "ecr",
+		RegistryHostPort: "5555",
+		S3: s3{
+			AccessKey:      "AKIAEXAMPLE",
+			SecretKey:      "secret",
+			Region:         "us-west-2",
+			RegistryBucket: "deis-registry",
+			DatabaseBucket: "deis-database",
+			BuilderBucket:  "deis-builder",
+		},
+		GCS: gcs{
+			KeyJSON:        "<base64-encoded JSON data>",
+			RegistryBucket: "your-registry-bucket-name",
+		},
+		Postgres: postgres{
+			Name:     "deis",
+			UserName: "deis",
+			Password: "postgres",
+			Host:     "db.example.com",
+			Port:     "5432",
+		},
+		ECR: ecr{
+			Region:     "us-west-2",
+			RegistryID: "123456789012",
+			HostName:   "123456789012.dkr.ecr.us-west-2.amazonaws.com",
+		},
+		Controller: controller{
+			AppPullPolicy: "Always",
+		},
+	}
+	if !reflect.DeepEqual(*values, want) {
+		t.Errorf("got %+v, want %+v", *values, want)
+	}
+
+	// the placeholders of the backends the locations don't use are dropped
+	values.pruneUnused()
+	if values.GCS != (gcs{}) {
+		t.Errorf("GCS placeholders survived pruning: %+v", values.GCS)
+	}
+	if values.S3 == (s3{}) || values.Postgres == (postgres{}) || values.ECR == (ecr{}) {
+		t.Errorf("pruning dropped a used section: %+v", *values)
+	}
+}
+
+func TestParseParamsInvalid(t *testing.T) {
+	if _, _, err := parseParams([]byte("storage = \n")); err == nil {
+		t.Error("expected an error for invalid TOML")
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	file := Values{StorageLocation: "s3", S3: s3{Region: "us-west-2", SecretKey: "a"}, Postgres: postgres{Host: "db"}}
+	cluster := Values{StorageLocation: "s3", S3: s3{Region: "us-east-1", SecretKey: "b"}}
+	got := diffValues("", reflect.ValueOf(file), reflect.ValueOf(cluster))
+	want := []string{
+		`S3.SecretKey: generate_params.toml and the cluster differ`,
+		`S3.Region: generate_params.toml has "us-west-2", the cluster has "us-east-1"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+)
+
+const (
+	authorizationGroup = "authorization.k8s.io"
+	rbacGroup          = "rbac.authorization.k8s.io"
+)
+
+// Permission is a single verb on a resource in a namespace. An empty Group is the
+// core API group. Subresources are given as resource/subresource, e.g. pods/exec.
+type Permission struct {
+	Namespace string
+	Group     string
+	Resource  string
+	Verb      string
+}
+
+func (p Permission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	return fmt.Sprintf("%s %s in %s", p.Verb, resource, p.Namespace)
+}
+
+type resourceAttributes struct {
+	Namespace   string `json:"namespace"`
+	Verb        string `json:"verb"`
+	Group       string `json:"group"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+}
+
+type selfSubjectAccessReview struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Spec       struct {
+		ResourceAttributes resourceAttributes `json:"resourceAttributes"`
+	} `json:"spec"`
+	Status struct {
+		Allowed bool   `json:"allowed"`
+		Reason  string `json:"reason,omitempty"`
+	} `json:"status"`
+}
+
+type policyRule struct {
+	APIGroups []string `json:"apiGroups"`
+	Resources []string `json:"resources"`
+	Verbs     []string `json:"verbs"`
+}
+
+type role struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Rules []policyRule `json:"rules"`
+}
+
+// MissingPermissions asks the API server, through SelfSubjectAccessReviews, which
+// of the permissions the current credentials lack.
+func MissingPermissions(kubeClient kubernetes.Interface, perms []Permission) ([]Permission, error) {
+	version, err := preferredVersion(kubeClient, authorizationGroup)
+	if err != nil {
+		return nil, err
+	}
+	var missing []Permission
+	for _, perm := range uniquePermissions(perms) {
+		review := selfSubjectAccessReview{
+			APIVersion: authorizationGroup + "/" + version,
+			Kind:       "SelfSubjectAccessReview",
+		}
+		resource := strings.SplitN(perm.Resource, "/", 2)
+		review.Spec.ResourceAttributes = resourceAttributes{
+			Namespace: perm.Namespace,
+			Verb:      perm.Verb,
+			Group:     perm.Group,
+			Resource:  resource[0],
+		}
+		if len(resource) == 2 {
+			review.Spec.ResourceAttributes.Subresource = resource[1]
+		}
+		body, err := json.Marshal(review)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := kubeClient.Core().GetRESTClient().Post().
+			AbsPath("/apis", authorizationGroup, version, "selfsubjectaccessreviews").
+			SetHeader("Content-Type", "application/json").
+			Body(body).
+			Do().
+			Raw()
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %v", perm, err)
+		}
+		result := selfSubjectAccessReview{}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return nil, err
+		}
+		if !result.Status.Allowed {
+			missing = append(missing, perm)
+		}
+	}
+	return missing, nil
+}
+
+// preferredVersion returns the version of an API group the server prefers.
+func preferredVersion(kubeClient kubernetes.Interface, group string) (string, error) {
+	groups, err := kubeClient.Discovery().ServerGroups()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range groups.Groups {
+		if g.Name == group {
+			return g.PreferredVersion.Version, nil
+		}
+	}
+	return "", fmt.Errorf("the server doesn't serve the %s API group", group)
+}
+
+// Roles renders the permissions as one Role per namespace, ready to be applied
+// with `kubectl apply -f`, in the version of the RBAC API the server prefers.
+func Roles(kubeClient kubernetes.Interface, perms []Permission, name string) (string, error) {
+	version, err := preferredVersion(kubeClient, rbacGroup)
+	if err != nil {
+		return "", err
+	}
+	return renderRoles(perms, name, rbacGroup+"/"+version)
+}
+
+func renderRoles(perms []Permission, name, apiVersion string) (string, error) {
+	verbs := make(map[ruleKey][]string)
+	var keys []ruleKey
+	for _, perm := range uniquePermissions(perms) {
+		key := ruleKey{perm.Namespace, perm.Group, perm.Resource}
+		if _, ok := verbs[key]; !ok {
+			keys = append(keys, key)
+		}
+		verbs[key] = append(verbs[key], perm.Verb)
+	}
+	sort.Sort(byRule(keys))
+
+	var roles []*role
+	for _, key := range keys {
+		if len(roles) == 0 || roles[len(roles)-1].Metadata.Namespace != key.namespace {
+			r := &role{APIVersion: apiVersion, Kind: "Role"}
+			r.Metadata.Name = name
+			r.Metadata.Namespace = key.namespace
+			roles = append(roles, r)
+		}
+		sort.Strings(verbs[key])
+		r := roles[len(roles)-1]
+		r.Rules = append(r.Rules, policyRule{APIGroups: []string{key.group}, Resources: []string{key.resource}, Verbs: verbs[key]})
+	}
+
+	b := bytes.NewBuffer(nil)
+	for _, r := range roles {
+		y, err := yaml.Marshal(r)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString("---\n")
+		b.Write(y)
+	}
+	return b.String(), nil
+}
+
+type ruleKey struct {
+	namespace, group, resource string
+}
+
+type byRule []ruleKey
+
+func (r byRule) Len() int      { return len(r) }
+func (r byRule) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byRule) Less(i, j int) bool {
+	if r[i].namespace != r[j].namespace {
+		return r[i].namespace < r[j].namespace
+	}
+	if r[i].group != r[j].group {
+		return r[i].group < r[j].group
+	}
+	return r[i].resource < r[j].resource
+}
+
+func uniquePermissions(perms []Permission) []Permission {
+	seen := make(map[Permission]struct{})
+	var unique []Permission
+	for _, perm := range perms {
+		if _, ok := seen[perm]; ok {
+			continue
+		}
+		seen[perm] = struct{}{}
+		unique = append(unique, perm)
+	}
+	return unique
+}
+
+// Verbs expands a comma separated list of verbs into permissions on one resource.
+func Verbs(namespace, group, resource, verbs string) []Permission {
+	var perms []Permission
+	for _, verb := range strings.Split(verbs, ",") {
+		perms = append(perms, Permission{Namespace: namespace, Group: group, Resource: resource, Verb: verb})
+	}
+	return perms
+}
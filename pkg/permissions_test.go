@@ -0,0 +1,123 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	perms := Verbs("deis", "", "secrets", "get")
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.discover("rbac.authorization.k8s.io/v1beta1")
+	got, err := Roles(clientset, perms, "workflow-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "---\napiVersion: rbac.authorization.k8s.io/v1beta1\nkind: Role\n") {
+		t.Errorf("got\n%s", got)
+	}
+
+	s2, clientset2 := newTestServer(t)
+	defer s2.Close()
+	s2.discover("apps/v1")
+	if _, err := Roles(clientset2, perms, "workflow-migration"); err == nil {
+		t.Error("rendered roles for a server without the RBAC API")
+	}
+}
+
+func TestRenderRoles(t *testing.T) {
+	var perms []Permission
+	perms = append(perms, Verbs("deis", "", "secrets", "get,update")...)
+	perms = append(perms, Verbs("kube-system", "", "configmaps", "get,create")...)
+	perms = append(perms, Verbs("deis", "extensions", "deployments", "delete,get")...)
+	perms = append(perms, Verbs("deis", "", "pods/exec", "create")...)
+	perms = append(perms, Verbs("deis", "", "secrets", "get")...)
+
+	got, err := renderRoles(perms, "workflow-migration", "rbac.authorization.k8s.io/v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: workflow-migration
+  namespace: deis
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - pods/exec
+  verbs:
+  - create
+- apiGroups:
+  - ""
+  resources:
+  - secrets
+  verbs:
+  - get
+  - update
+- apiGroups:
+  - extensions
+  resources:
+  - deployments
+  verbs:
+  - delete
+  - get
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: workflow-migration
+  namespace: kube-system
+rules:
+- apiGroups:
+  - ""
+  resources:
+  - configmaps
+  verbs:
+  - create
+  - get
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPermissionString(t *testing.T) {
+	tests := map[Permission]string{
+		{Namespace: "deis", Resource: "pods/exec", Verb: "create"}:                        "create pods/exec in deis",
+		{Namespace: "deis", Group: "extensions", Resource: "deployments", Verb: "delete"}: "delete deployments.extensions in deis",
+	}
+	for perm, want := range tests {
+		if got := perm.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLookupPermissions(t *testing.T) {
+	objs := []ObjectRef{
+		{"Service", "deis", "deis-router"},
+		{"Secret", "deis", "database-creds"},
+		{"Service", "deis", "deis-controller"},
+		{"ReplicationController", "deis", "deis-logger-redis"},
+		{"Ingress", "deis", "deis-router"},
+	}
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	got, err := LookupPermissions(clientset, objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Permission{
+		{Namespace: "deis", Resource: "services", Verb: "get"},
+		{Namespace: "deis", Resource: "secrets", Verb: "get"},
+		{Namespace: "deis", Resource: "replicationcontrollers", Verb: "get"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
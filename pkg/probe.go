@@ -0,0 +1,202 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProbeResult summarizes the availability of one app hostname during a probe.
+type ProbeResult struct {
+	Host          string `json:"host"`
+	Requests      int    `json:"requests"`
+	Failures      int    `json:"failures"`
+	AvgLatency    string `json:"avgLatency"`
+	MaxLatency    string `json:"maxLatency"`
+	LongestOutage string `json:"longestOutage"`
+}
+
+type hostStats struct {
+	requests      int
+	failures      int
+	totalLatency  time.Duration
+	maxLatency    time.Duration
+	downSince     time.Time
+	longestOutage time.Duration
+}
+
+// outage returns the length of the current outage, zero if the host is up.
+func (h *hostStats) outage(now time.Time) time.Duration {
+	if h.downSince.IsZero() {
+		return 0
+	}
+	return now.Sub(h.downSince)
+}
+
+// Probe sends requests for a set of app hostnames through the router at a fixed
+// interval and records failures, latency and outages. A response with a status
+// below 500 counts as the app being available.
+type Probe struct {
+	router      string
+	hosts       []string
+	interval    time.Duration
+	maxDowntime time.Duration
+	client      *http.Client
+
+	mu    sync.Mutex
+	stats map[string]*hostStats
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// NewProbe returns a probe for the hosts, sent to router (host or host:port). A
+// request that takes longer than timeout counts as a failure, so timeout should
+// leave a slow app a few intervals to answer. Check fails once any host has been
+// unavailable for longer than maxDowntime.
+func NewProbe(router string, hosts []string, interval, timeout, maxDowntime time.Duration) *Probe {
+	stats := make(map[string]*hostStats)
+	for _, host := range hosts {
+		stats[host] = &hostStats{}
+	}
+	return &Probe{
+		router:      router,
+		hosts:       hosts,
+		interval:    interval,
+		maxDowntime: maxDowntime,
+		client:      &http.Client{Timeout: timeout},
+		stats:       stats,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start begins probing in the background. The first round of requests is done
+// before Start returns so that Check reflects the state before any mutation.
+func (p *Probe) Start() {
+	p.round()
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.round()
+			}
+		}
+	}()
+}
+
+// Stop ends probing and returns the results per host.
+func (p *Probe) Stop() []ProbeResult {
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	results := make([]ProbeResult, 0, len(p.hosts))
+	for _, host := range p.hosts {
+		h := p.stats[host]
+		longest := h.longestOutage
+		if outage := h.outage(now); outage > longest {
+			longest = outage
+		}
+		var avg time.Duration
+		if h.requests > 0 {
+			avg = h.totalLatency / time.Duration(h.requests)
+		}
+		results = append(results, ProbeResult{
+			Host:          host,
+			Requests:      h.requests,
+			Failures:      h.failures,
+			AvgLatency:    avg.String(),
+			MaxLatency:    h.maxLatency.String(),
+			LongestOutage: longest.String(),
+		})
+	}
+	return results
+}
+
+// Check returns an error listing every host whose current or a past outage
+// lasted longer than the allowed downtime.
+func (p *Probe) Check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var broken []string
+	for host, h := range p.stats {
+		longest := h.longestOutage
+		if outage := h.outage(now); outage > longest {
+			longest = outage
+		}
+		// a host that never answered is broken even before maxDowntime has passed
+		if longest > p.maxDowntime || (h.requests > 0 && h.failures == h.requests) {
+			broken = append(broken, fmt.Sprintf("%s (down for %s, %d/%d requests failed)", host, longest, h.failures, h.requests))
+		}
+	}
+	if len(broken) > 0 {
+		sort.Strings(broken)
+		return fmt.Errorf("apps unavailable: %s", strings.Join(broken, ", "))
+	}
+	return nil
+}
+
+// round sends one request per host concurrently and records the outcome.
+func (p *Probe) round() {
+	var wg sync.WaitGroup
+	for _, host := range p.hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			start := time.Now()
+			err := p.request(host)
+			p.record(host, start, time.Since(start), err)
+		}(host)
+	}
+	wg.Wait()
+}
+
+func (p *Probe) request(host string) error {
+	req, err := http.NewRequest("GET", "http://"+p.router+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Probe) record(host string, start time.Time, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.stats[host]
+	h.requests++
+	h.totalLatency += latency
+	if latency > h.maxLatency {
+		h.maxLatency = latency
+	}
+	if err != nil {
+		h.failures++
+		if h.downSince.IsZero() {
+			h.downSince = start
+		}
+		return
+	}
+	if outage := h.outage(start); outage > h.longestOutage {
+		h.longestOutage = outage
+	}
+	h.downSince = time.Time{}
+}
@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeRound(t *testing.T) {
+	router := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "up.example.com":
+			w.WriteHeader(http.StatusOK)
+		case "missing.example.com":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer router.Close()
+
+	hosts := []string{"up.example.com", "missing.example.com", "down.example.com"}
+	p := NewProbe(strings.TrimPrefix(router.URL, "http://"), hosts, time.Hour, time.Second, time.Hour)
+	p.Start()
+	err := p.Check()
+	results := p.Stop()
+
+	if err == nil || !strings.Contains(err.Error(), "down.example.com") || strings.Contains(err.Error(), "up.example.com") {
+		t.Errorf("got %v, want only down.example.com reported as never answering", err)
+	}
+	want := map[string]int{"up.example.com": 0, "missing.example.com": 0, "down.example.com": 1}
+	for _, result := range results {
+		if result.Requests != 1 || result.Failures != want[result.Host] {
+			t.Errorf("%s: got %d/%d requests failed, want %d/1", result.Host, result.Failures, result.Requests, want[result.Host])
+		}
+	}
+}
+
+func TestProbeDowntime(t *testing.T) {
+	p := NewProbe("router", []string{"app.example.com"}, time.Second, time.Second, 10*time.Second)
+	start := time.Now().Add(-time.Minute)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	failure := errors.New("status 503")
+
+	p.record("app.example.com", at(0), time.Millisecond, nil)
+	p.record("app.example.com", at(time.Second), time.Millisecond, failure)
+	p.record("app.example.com", at(2*time.Second), time.Millisecond, failure)
+	p.record("app.example.com", at(6*time.Second), time.Millisecond, nil)
+	if err := p.Check(); err != nil {
+		t.Fatalf("a 5s outage is within the allowed downtime: %v", err)
+	}
+	h := p.stats["app.example.com"]
+	if h.longestOutage != 5*time.Second || !h.downSince.IsZero() {
+		t.Errorf("got longest outage %s and down since %v, want 5s and up", h.longestOutage, h.downSince)
+	}
+
+	p.record("app.example.com", at(7*time.Second), time.Millisecond, failure)
+	p.record("app.example.com", at(30*time.Second), time.Millisecond, nil)
+	err := p.Check()
+	if err == nil || !strings.Contains(err.Error(), "down for 23s") {
+		t.Errorf("got %v, want the 23s outage reported", err)
+	}
+
+	p.record("app.example.com", at(40*time.Second), time.Millisecond, failure)
+	if h.outage(at(45*time.Second)) != 5*time.Second {
+		t.Errorf("current outage = %s, want 5s", h.outage(at(45*time.Second)))
+	}
+	if h.requests != 7 || h.failures != 4 {
+		t.Errorf("got %d/%d requests failed, want 4/7", h.failures, h.requests)
+	}
+}
@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/labels"
+)
+
+const (
+	// ResourcePolicyAnnotation tells helm to leave an object behind on `helm delete`.
+	ResourcePolicyAnnotation = "helm.sh/resource-policy"
+	resourcePolicyKeep       = "keep"
+)
+
+// statefulSecrets hold credentials and keys that can't be regenerated without
+// breaking existing data, users or apps.
+var statefulSecrets = []string{
+	"objectstorage-keyfile",
+	"database-creds",
+	"builder-key-auth",
+	"builder-ssh-private-keys",
+	"deis-router-platform-cert",
+	"deis-router-dhparam",
+}
+
+// statefulComponents are the app labels of the on-cluster database and minio, whose
+// persistent volume claims hold their data.
+var statefulComponents = []string{databaseLabel, "deis-minio"}
+
+// StatefulObjects returns the stateful objects present in namespace.
+func StatefulObjects(kubeClient kubernetes.Interface, namespace string) ([]ObjectRef, error) {
+	claims, err := statefulClaims(kubeClient, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var objs []ObjectRef
+	for _, claim := range claims {
+		_, err := kubeClient.Core().PersistentVolumeClaims(namespace).Get(claim)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		objs = append(objs, ObjectRef{Kind: "PersistentVolumeClaim", Namespace: namespace, Name: claim})
+	}
+	for _, secret := range statefulSecrets {
+		_, err := kubeClient.Core().Secrets(namespace).Get(secret)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		objs = append(objs, ObjectRef{Kind: "Secret", Namespace: namespace, Name: secret})
+	}
+	return objs, nil
+}
+
+// statefulClaims returns the persistent volume claims mounted by the pods of the
+// statefulComponents, by name.
+func statefulClaims(kubeClient kubernetes.Interface, namespace string) ([]string, error) {
+	seen := make(map[string]struct{})
+	var claims []string
+	for _, component := range statefulComponents {
+		pods, err := kubeClient.Core().Pods(namespace).List(api.ListOptions{LabelSelector: labels.Set{"app": component}.AsSelector()})
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods.Items {
+			for _, volume := range pod.Spec.Volumes {
+				if volume.PersistentVolumeClaim == nil {
+					continue
+				}
+				name := volume.PersistentVolumeClaim.ClaimName
+				if _, ok := seen[name]; !ok {
+					seen[name] = struct{}{}
+					claims = append(claims, name)
+				}
+			}
+		}
+	}
+	sort.Strings(claims)
+	return claims, nil
+}
+
+// Protect sets the keep resource policy on objMeta.
+func Protect(objMeta *v1.ObjectMeta) {
+	if objMeta.Annotations == nil {
+		objMeta.Annotations = make(map[string]string)
+	}
+	objMeta.Annotations[ResourcePolicyAnnotation] = resourcePolicyKeep
+}
+
+// ProtectObjects annotates the live objects with the keep resource policy.
+func ProtectObjects(kubeClient kubernetes.Interface, objs []ObjectRef) error {
+	patch, err := annotationsPatch(map[string]string{ResourcePolicyAnnotation: resourcePolicyKeep})
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		_, err := retry(retryAttempts, retryWait, func() error {
+			return PatchObject(kubeClient, obj, patch)
+		})
+		if err != nil {
+			return fmt.Errorf("protecting %s: %v", obj, err)
+		}
+	}
+	return nil
+}
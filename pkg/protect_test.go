@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+)
+
+func claimPod(name, app string, claims ...string) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: v1.ObjectMeta{Name: name, Labels: map[string]string{"app": app}}}
+	for _, claim := range claims {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+			Name:         claim,
+			VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim}},
+		})
+	}
+	return pod
+}
+
+func TestStatefulObjects(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.add(t, "/api/v1/namespaces/workflow/pods", claimPod("deis-database-1", "deis-database", "database-data"))
+	s.add(t, "/api/v1/namespaces/workflow/pods", claimPod("deis-minio-1", "deis-minio", "minio-data", "minio-missing"))
+	s.add(t, "/api/v1/namespaces/workflow/pods", claimPod("deis-minio-2", "deis-minio", "minio-data"))
+	s.add(t, "/api/v1/namespaces/workflow/pods", claimPod("deis-database-exporter-1", "deis-database-exporter", "database-exporter-cache"))
+	for _, claim := range []string{"database-data", "minio-data", "database-exporter-cache", "my-database-app"} {
+		s.add(t, "/api/v1/namespaces/workflow/persistentvolumeclaims", &v1.PersistentVolumeClaim{ObjectMeta: v1.ObjectMeta{Name: claim}})
+	}
+	s.add(t, "/api/v1/namespaces/workflow/secrets", &v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "database-creds"}})
+
+	objs, err := StatefulObjects(clientset, "workflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ObjectRef{
+		{"PersistentVolumeClaim", "workflow", "database-data"},
+		{"PersistentVolumeClaim", "workflow", "minio-data"},
+		{"Secret", "workflow", "database-creds"},
+	}
+	if !reflect.DeepEqual(objs, want) {
+		t.Errorf("got %v, want %v", objs, want)
+	}
+}
@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"github.com/ghodss/yaml"
+)
+
+// Report summarizes what a migration run did.
+type Report struct {
+	Release             string        `json:"release"`
+	Bundle              string        `json:"bundle,omitempty"`
+	Revision            int32         `json:"revision"`
+	Target              string        `json:"target"`
+	Storage             string        `json:"storage,omitempty"`
+	DatabaseBackup      string        `json:"databaseBackup,omitempty"`
+	AnnotatedSecrets    []string      `json:"annotatedSecrets,omitempty"`
+	SecretMutations     []string      `json:"secretMutations,omitempty"`
+	ParamsDisagreements []string      `json:"paramsDisagreements,omitempty"`
+	ParamsUnknownKeys   []string      `json:"paramsUnknownKeys,omitempty"`
+	Superseded          []string      `json:"superseded,omitempty"`
+	Protected           []string      `json:"protected,omitempty"`
+	Tiller              string        `json:"tiller,omitempty"`
+	Upgrade             string        `json:"upgrade,omitempty"`
+	Watchdog            string        `json:"watchdog,omitempty"`
+	BeforeUpgrade       []string      `json:"beforeUpgrade,omitempty"`
+	Probe               []ProbeResult `json:"probe,omitempty"`
+}
+
+// YAML renders the report.
+func (r *Report) YAML() (string, error) {
+	y, err := yaml.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(y), nil
+}
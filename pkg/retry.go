@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"time"
+
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+)
+
+const retryAttempts = 5
+
+// retryWait is the wait before the first retry. Tests shorten it.
+var retryWait = time.Second
+
+// retry calls fn until it succeeds, fails with an error that isn't worth retrying or
+// runs out of attempts. The wait between attempts doubles each time. It returns the
+// number of attempts made along with the last error.
+func retry(attempts int, wait time.Duration, fn func() error) (int, error) {
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(); err == nil || !isRetryable(err) || i >= attempts {
+			return i, err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// isRetryable reports whether err is a conflict, a timeout or a server error.
+// Anything else, including errors that don't come from the API server, is returned
+// as it is.
+func isRetryable(err error) bool {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		return false
+	}
+	return apierrors.IsConflict(err) || apierrors.IsServerTimeout(err) || status.Status().Code >= 500
+}
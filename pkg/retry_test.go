@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/unversioned"
+)
+
+var secretsResource = unversioned.GroupResource{Resource: "secrets"}
+
+func TestRetry(t *testing.T) {
+	conflict := apierrors.NewConflict(secretsResource, "database-creds", errors.New("changed"))
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", nil, 1, nil},
+		{"conflicts then success", []error{conflict, conflict}, 3, nil},
+		{"not found", []error{apierrors.NewNotFound(secretsResource, "database-creds")}, 1, apierrors.NewNotFound(secretsResource, "database-creds")},
+		{"conflicts until the attempts run out", []error{conflict, conflict, conflict, conflict}, 3, conflict},
+	}
+	for _, test := range tests {
+		calls := 0
+		attempts, err := retry(3, time.Millisecond, func() error {
+			calls++
+			if calls <= len(test.errs) {
+				return test.errs[calls-1]
+			}
+			return nil
+		})
+		if attempts != test.wantAttempts || calls != test.wantAttempts {
+			t.Errorf("%s: got %d attempt(s) and %d call(s), want %d", test.name, attempts, calls, test.wantAttempts)
+		}
+		if (err == nil) != (test.wantErr == nil) || (err != nil && err.Error() != test.wantErr.Error()) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{apierrors.NewConflict(secretsResource, "database-creds", errors.New("changed")), true},
+		{apierrors.NewServerTimeout(secretsResource, "patch", 1), true},
+		{apierrors.NewInternalError(errors.New("etcd unavailable")), true},
+		{apierrors.NewTimeoutError("request timed out", 1), true},
+		{apierrors.NewNotFound(secretsResource, "database-creds"), false},
+		{apierrors.NewForbidden(secretsResource, "database-creds", errors.New("denied")), false},
+		{apierrors.NewBadRequest("invalid patch"), false},
+		{apierrors.NewServiceUnavailable("apiserver restarting"), true},
+		{errors.New("connection reset by peer"), false},
+	}
+	for _, test := range tests {
+		if got := isRetryable(test.err); got != test.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"k8s.io/helm/pkg/chartutil"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/proto/hapi/services"
+)
+
+// TillerServiceHost returns the address of the tiller-deploy service in namespace
+// from inside the cluster.
+func TillerServiceHost(namespace string) string {
+	return fmt.Sprintf("%s.%s:44134", tillerDeployment, namespace)
+}
+
+// Tiller checks the version of the client in every call against its own.
+const helmAPIClientHeader = "x-helm-api-client"
+
+// Tiller is a client of Tiller's ReleaseService.
+type Tiller struct {
+	conn    *grpc.ClientConn
+	client  services.ReleaseServiceClient
+	version string
+}
+
+// DialTiller connects to Tiller at host, which is the tiller-deploy service or a
+// port forwarded to it. version is sent as the helm client version, none if empty.
+// tlsConfig is used for a Tiller that requires TLS, the connection is plain if nil.
+func DialTiller(host, version string, tlsConfig *tls.Config, timeout time.Duration) (*Tiller, error) {
+	security := grpc.WithInsecure()
+	if tlsConfig != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	conn, err := grpc.Dial(host, security, grpc.WithBlock(), grpc.WithTimeout(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to tiller at %s: %v", host, err)
+	}
+	return &Tiller{conn: conn, client: services.NewReleaseServiceClient(conn), version: version}, nil
+}
+
+// TillerTLSConfig returns the client TLS config helm uses with --tls, from the
+// cert.pem and key.pem in the helm home directory. With verify, Tiller's
+// certificate is checked against the ca.pem there, like with --tls-verify.
+func TillerTLSConfig(home string, verify bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(home, "cert.pem"), filepath.Join(home, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("loading the helm client certificate from %s: %v", home, err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: !verify}
+	if verify {
+		ca, err := ioutil.ReadFile(filepath.Join(home, "ca.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("loading the tiller CA certificate: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", filepath.Join(home, "ca.pem"))
+		}
+	}
+	return config, nil
+}
+
+// Close closes the connection to Tiller.
+func (t *Tiller) Close() error {
+	return t.conn.Close()
+}
+
+func (t *Tiller) context(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if t.version != "" {
+		ctx = metadata.NewContext(ctx, metadata.Pairs(helmAPIClientHeader, t.version))
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// CheckRelease confirms that Tiller reads the given revision of the release from
+// its storage and reports it as deployed, and returns the status it reports.
+func (t *Tiller) CheckRelease(name string, version int32) (string, error) {
+	ctx, cancel := t.context(time.Minute)
+	defer cancel()
+	status, err := t.client.GetReleaseStatus(ctx, &services.GetReleaseStatusRequest{Name: name, Version: version})
+	if err != nil {
+		return "", fmt.Errorf("getting the status of %s revision %d: %v", name, version, err)
+	}
+	content, err := t.client.GetReleaseContent(ctx, &services.GetReleaseContentRequest{Name: name, Version: version})
+	if err != nil {
+		return "", fmt.Errorf("getting the content of %s revision %d: %v", name, version, err)
+	}
+	if content.Release == nil || content.Release.Version != version {
+		return "", fmt.Errorf("tiller returned no release %s revision %d", name, version)
+	}
+	var code rspb.Status_Code
+	if s := status.Info.GetStatus(); s != nil {
+		code = s.Code
+	}
+	if code != rspb.Status_DEPLOYED {
+		return code.String(), fmt.Errorf("tiller reports %s revision %d as %s", name, version, code)
+	}
+	return code.String(), nil
+}
+
+// UpgradeRelease upgrades the release to the chart archive or directory at path.
+// The values of the current release are passed along, since Tiller would otherwise
+// render the chart with its defaults.
+func (t *Tiller) UpgradeRelease(current *rspb.Release, path string, timeout time.Duration) (*rspb.Release, error) {
+	chrt, err := chartutil.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading chart %s: %v", path, err)
+	}
+	ctx, cancel := t.context(timeout + time.Minute)
+	defer cancel()
+	resp, err := t.client.UpdateRelease(ctx, &services.UpdateReleaseRequest{
+		Name:   current.Name,
+		Chart:  chrt,
+		Values: current.Config,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("upgrading %s to %s: %v", current.Name, path, err)
+	}
+	return resp.Release, nil
+}
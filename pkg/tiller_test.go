@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+	"k8s.io/helm/pkg/proto/hapi/services"
+)
+
+// fakeTiller serves the revisions of a single release. The ReleaseService methods
+// the migration doesn't call are left to the embedded nil interface.
+type fakeTiller struct {
+	services.ReleaseServiceServer
+
+	mu       sync.Mutex
+	releases map[int32]*rspb.Release
+	versions []string
+	updates  []*services.UpdateReleaseRequest
+}
+
+func (f *fakeTiller) record(ctx context.Context) {
+	md, _ := metadata.FromContext(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.versions = append(f.versions, strings.Join(md[helmAPIClientHeader], ","))
+}
+
+func (f *fakeTiller) release(name string, version int32) (*rspb.Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rls, ok := f.releases[version]
+	if !ok || rls.Name != name {
+		return nil, grpc.Errorf(codes.NotFound, "release: %q not found", name)
+	}
+	return rls, nil
+}
+
+func (f *fakeTiller) GetReleaseStatus(ctx context.Context, req *services.GetReleaseStatusRequest) (*services.GetReleaseStatusResponse, error) {
+	f.record(ctx)
+	rls, err := f.release(req.Name, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &services.GetReleaseStatusResponse{Name: rls.Name, Namespace: rls.Namespace, Info: rls.Info}, nil
+}
+
+func (f *fakeTiller) GetReleaseContent(ctx context.Context, req *services.GetReleaseContentRequest) (*services.GetReleaseContentResponse, error) {
+	f.record(ctx)
+	rls, err := f.release(req.Name, req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &services.GetReleaseContentResponse{Release: rls}, nil
+}
+
+func (f *fakeTiller) UpdateRelease(ctx context.Context, req *services.UpdateReleaseRequest) (*services.UpdateReleaseResponse, error) {
+	f.record(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updates = append(f.updates, req)
+	rls := testRelease(int32(len(f.releases) + 1))
+	rls.Chart = req.Chart
+	rls.Config = req.Values
+	f.releases[rls.Version] = rls
+	return &services.UpdateReleaseResponse{Release: rls}, nil
+}
+
+// startTiller serves f on a local port and returns a client connected to it.
+func startTiller(t *testing.T, f *fakeTiller, version string) (*Tiller, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	services.RegisterReleaseServiceServer(server, f)
+	go server.Serve(lis)
+	tiller, err := DialTiller(lis.Addr().String(), version, nil, 10*time.Second)
+	if err != nil {
+		server.Stop()
+		t.Fatal(err)
+	}
+	return tiller, func() {
+		tiller.Close()
+		server.Stop()
+	}
+}
+
+func TestCheckRelease(t *testing.T) {
+	superseded := testRelease(1)
+	superseded.Info.Status.Code = rspb.Status_SUPERSEDED
+	f := &fakeTiller{releases: map[int32]*rspb.Release{1: superseded, 2: testRelease(2)}}
+	tiller, stop := startTiller(t, f, "v2.1.3")
+	defer stop()
+
+	status, err := tiller.CheckRelease("deis-workflow", 2)
+	if err != nil || status != "DEPLOYED" {
+		t.Errorf("got %q, %v checking the deployed revision", status, err)
+	}
+	status, err = tiller.CheckRelease("deis-workflow", 1)
+	if err == nil || status != "SUPERSEDED" {
+		t.Errorf("got %q, %v checking a superseded revision", status, err)
+	}
+	if _, err := tiller.CheckRelease("deis-workflow", 3); err == nil || !strings.Contains(err.Error(), "revision 3") {
+		t.Errorf("got %v checking a missing revision", err)
+	}
+	for _, version := range f.versions {
+		if version != "v2.1.3" {
+			t.Errorf("got client version %q, want v2.1.3", version)
+		}
+	}
+}
+
+func TestUpgradeRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workflow-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chartDir := filepath.Join(dir, "workflow")
+	if err := os.MkdirAll(filepath.Join(chartDir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("name: workflow\nversion: v2.8.0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(chartDir, "templates", "router-service.yaml"), []byte("kind: Service\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	current := testRelease(1)
+	f := &fakeTiller{releases: map[int32]*rspb.Release{1: current}}
+	tiller, stop := startTiller(t, f, "")
+	defer stop()
+
+	upgraded, err := tiller.UpgradeRelease(current, chartDir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md := upgraded.GetChart().GetMetadata(); upgraded.Version != 2 || md == nil || md.Version != "v2.8.0" {
+		t.Errorf("got release %s revision %d of chart %v", upgraded.Name, upgraded.Version, md)
+	}
+	if len(f.updates) != 1 {
+		t.Fatalf("got %d update requests, want 1", len(f.updates))
+	}
+	if req := f.updates[0]; req.Name != "deis-workflow" || req.Values == nil || req.Values.Raw != current.Config.Raw || len(req.Chart.GetTemplates()) != 1 {
+		t.Errorf("got update request %v", req)
+	}
+	if f.versions[0] != "" {
+		t.Errorf("sent client version %q, want none", f.versions[0])
+	}
+
+	if _, err := tiller.UpgradeRelease(current, filepath.Join(dir, "missing"), time.Minute); err == nil {
+		t.Error("upgrading to a missing chart succeeded")
+	}
+}
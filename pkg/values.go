@@ -7,6 +7,7 @@ import (
 
 	"k8s.io/client-go/1.5/kubernetes"
 	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
 )
 
 const (
@@ -14,7 +15,8 @@ const (
 	onCluster  = "on-cluster"
 )
 
-type valuesConfig struct {
+// Values are the values of the workflow chart that reproduce the current install.
+type Values struct {
 	StorageLocation       string
 	DatabaseLocation      string
 	RedisLocation         string
@@ -36,6 +38,11 @@ type valuesConfig struct {
 	GCR                   gcr
 	OffClusterRegistry    offClusterRegistry
 	Router                router
+
+	// namespace is where workflow is installed
+	namespace string
+	// mutations are the changes to secrets the values rely on
+	mutations []SecretMutation
 }
 
 type s3 struct {
@@ -301,8 +308,8 @@ router:
 `
 )
 
-func (v *valuesConfig) updateStorageparams(kubeClient *kubernetes.Clientset) error {
-	objSecret, err := kubeClient.Secrets("deis").Get("objectstorage-keyfile")
+func (v *Values) updateStorageparams(kubeClient kubernetes.Interface) error {
+	objSecret, err := kubeClient.Core().Secrets(v.namespace).Get("objectstorage-keyfile")
 	if err != nil {
 		return err
 	}
@@ -353,9 +360,9 @@ func (v *valuesConfig) updateStorageparams(kubeClient *kubernetes.Clientset) err
 	return nil
 }
 
-func (v *valuesConfig) updateRegistryparams(kubeClient *kubernetes.Clientset) error {
+func (v *Values) updateRegistryparams(kubeClient kubernetes.Interface) error {
 	v.RegistryLocation = onCluster
-	objSecret, err := kubeClient.Secrets("deis").Get("registry-secret")
+	objSecret, err := kubeClient.Core().Secrets(v.namespace).Get("registry-secret")
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
@@ -391,7 +398,8 @@ func (v *valuesConfig) updateRegistryparams(kubeClient *kubernetes.Clientset) er
 	}
 	v.RegistryHostPort = "5555"
 	v.ImagePullSecretPrefix = ""
-	controllerDeployment, err := kubeClient.Deployments("deis").Get("deis-controller")
+	controllerDeployment := &v1beta1.Deployment{}
+	err = getObject(kubeClient, "Deployment", v.namespace, "deis-controller", controllerDeployment)
 	if err != nil {
 		return err
 	}
@@ -408,10 +416,11 @@ func (v *valuesConfig) updateRegistryparams(kubeClient *kubernetes.Clientset) er
 	return nil
 }
 
-func (v *valuesConfig) updateRedisparams(kubeClient *kubernetes.Clientset) error {
+func (v *Values) updateRedisparams(kubeClient kubernetes.Interface) error {
 	v.RedisLocation = onCluster
 	v.Redis = redis{}
-	loggerDeployment, err := kubeClient.Deployments("deis").Get("deis-logger")
+	loggerDeployment := &v1beta1.Deployment{}
+	err := getObject(kubeClient, "Deployment", v.namespace, "deis-logger", loggerDeployment)
 	if err != nil {
 		return err
 	}
@@ -428,28 +437,27 @@ func (v *valuesConfig) updateRedisparams(kubeClient *kubernetes.Clientset) error
 		}
 	}
 	if v.Redis.Host != "" {
-		redisSecret, err := kubeClient.Secrets("deis").Get("logger-redis-creds")
+		redisSecret, err := kubeClient.Core().Secrets(v.namespace).Get("logger-redis-creds")
 		if err != nil {
 			return err
 		}
 		v.Redis.Password = string(redisSecret.Data["password"])
 		v.RedisLocation = offCluster
-		// Update the redis secret as the secret template updated in the new helm charts.
-		// `helm upgrade` doesn't upgrade as this set as pre-install hook.
-		redisSecret.Data["db"] = []byte(v.Redis.DB)
-		redisSecret.Data["host"] = []byte(v.Redis.Host)
-		redisSecret.Data["port"] = []byte(v.Redis.Port)
-		if _, err := kubeClient.Secrets("deis").Update(redisSecret); err != nil {
-			return err
-		}
+		// The redis secret template was updated in the new helm charts, and
+		// `helm upgrade` doesn't upgrade it as it is a pre-install hook.
+		v.mutations = append(v.mutations, SecretMutation{
+			Name: "logger-redis-creds",
+			Data: map[string]string{"db": v.Redis.DB, "host": v.Redis.Host, "port": v.Redis.Port},
+		})
 	}
 
 	return nil
 }
 
-func (v *valuesConfig) updateDatabaseParams(kubeClient *kubernetes.Clientset) error {
+func (v *Values) updateDatabaseParams(kubeClient kubernetes.Interface) error {
 	v.DatabaseLocation = onCluster
-	controllerDeployment, err := kubeClient.Deployments("deis").Get("deis-controller")
+	controllerDeployment := &v1beta1.Deployment{}
+	err := getObject(kubeClient, "Deployment", v.namespace, "deis-controller", controllerDeployment)
 	if err != nil && !apierrors.IsNotFound(err) {
 		return err
 	}
@@ -469,7 +477,7 @@ func (v *valuesConfig) updateDatabaseParams(kubeClient *kubernetes.Clientset) er
 			}
 		}
 		if postgresDetails.Name != "" {
-			postgresSecret, err := kubeClient.Secrets("deis").Get("database-creds")
+			postgresSecret, err := kubeClient.Core().Secrets(v.namespace).Get("database-creds")
 			if err != nil {
 				return err
 			}
@@ -477,22 +485,21 @@ func (v *valuesConfig) updateDatabaseParams(kubeClient *kubernetes.Clientset) er
 			postgresDetails.Password = string(postgresSecret.Data["password"])
 			v.Postgres = postgresDetails
 			v.DatabaseLocation = offCluster
-			// Update the database secret as the secret template updated in the new helm charts.
-			// `helm upgrade` doesn't upgrade as this set as pre-install hook.
-			postgresSecret.Data["name"] = []byte(postgresDetails.Name)
-			postgresSecret.Data["host"] = []byte(postgresDetails.Host)
-			postgresSecret.Data["port"] = []byte(postgresDetails.Port)
-			if _, err := kubeClient.Secrets("deis").Update(postgresSecret); err != nil {
-				return err
-			}
+			// The database secret template was updated in the new helm charts, and
+			// `helm upgrade` doesn't upgrade it as it is a pre-install hook.
+			v.mutations = append(v.mutations, SecretMutation{
+				Name: "database-creds",
+				Data: map[string]string{"name": postgresDetails.Name, "host": postgresDetails.Host, "port": postgresDetails.Port},
+			})
 		}
 	}
 	return nil
 }
 
-func (v *valuesConfig) updateInfluxparams(kubeClient *kubernetes.Clientset) error {
+func (v *Values) updateInfluxparams(kubeClient kubernetes.Interface) error {
 	v.InfluxDBLocation = onCluster
-	telegrafDaemonSet, err := kubeClient.DaemonSets("deis").Get("deis-monitor-telegraf")
+	telegrafDaemonSet := &v1beta1.DaemonSet{}
+	err := getObject(kubeClient, "DaemonSet", v.namespace, "deis-monitor-telegraf", telegrafDaemonSet)
 	if err != nil {
 		return err
 	}
@@ -518,9 +525,9 @@ func (v *valuesConfig) updateInfluxparams(kubeClient *kubernetes.Clientset) erro
 	return nil
 }
 
-func (v *valuesConfig) updateGrafanaparams(kubeClient *kubernetes.Clientset) error {
+func (v *Values) updateGrafanaparams(kubeClient kubernetes.Interface) error {
 	v.GrafanaLocation = onCluster
-	_, err := kubeClient.Deployments("deis").Get("deis-monitor-grafana")
+	err := getObject(kubeClient, "Deployment", v.namespace, "deis-monitor-grafana", &v1beta1.Deployment{})
 	if err != nil {
 		if apierrors.IsNotFound(err) {
 			v.GrafanaLocation = offCluster
@@ -530,12 +537,13 @@ func (v *valuesConfig) updateGrafanaparams(kubeClient *kubernetes.Clientset) err
 	return nil
 }
 
-func (v *valuesConfig) updateControllerparams(kubeClient *kubernetes.Clientset) error {
+func (v *Values) updateControllerparams(kubeClient kubernetes.Interface) error {
 	v.Controller = controller{
 		AppPullPolicy:    "IfNotPresent",
 		RegistrationMode: "enabled",
 	}
-	controllerDeployment, err := kubeClient.Deployments("deis").Get("deis-controller")
+	controllerDeployment := &v1beta1.Deployment{}
+	err := getObject(kubeClient, "Deployment", v.namespace, "deis-controller", controllerDeployment)
 	if err != nil {
 		return err
 	}
@@ -552,38 +560,72 @@ func (v *valuesConfig) updateControllerparams(kubeClient *kubernetes.Clientset)
 	return nil
 }
 
-// GetValues gets the values used for cluster configuration
-func GetValues(kubeClient *kubernetes.Clientset) (string, error) {
-	workflowConfig := &valuesConfig{}
+// GetValues gets the values used for cluster configuration. It doesn't change
+// anything in the cluster; the changes to secrets the values rely on are returned
+// for ApplySecretMutations instead.
+func GetValues(kubeClient kubernetes.Interface, namespace string) (string, []SecretMutation, error) {
+	workflowConfig, mutations, err := ReadValues(kubeClient, namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	raw, err := workflowConfig.Render()
+	if err != nil {
+		return "", nil, err
+	}
+	return raw, mutations, nil
+}
+
+// ReadValues reconstructs the values of the install in namespace from the cluster,
+// along with the changes to secrets the values rely on. Like GetValues it changes
+// nothing.
+func ReadValues(kubeClient kubernetes.Interface, namespace string) (*Values, []SecretMutation, error) {
+	workflowConfig, err := clusterValues(kubeClient, namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	return workflowConfig, workflowConfig.mutations, nil
+}
+
+// Render renders the values as the values.yaml of the workflow chart.
+func (v *Values) Render() (string, error) {
+	return renderValues(v)
+}
+
+// clusterValues reconstructs the values of the install from the cluster.
+func clusterValues(kubeClient kubernetes.Interface, namespace string) (*Values, error) {
+	workflowConfig := &Values{namespace: namespace}
 	err := workflowConfig.updateStorageparams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = workflowConfig.updateDatabaseParams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = workflowConfig.updateGrafanaparams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = workflowConfig.updateInfluxparams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = workflowConfig.updateRedisparams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = workflowConfig.updateRegistryparams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	err = workflowConfig.updateControllerparams(kubeClient)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return workflowConfig, nil
+}
 
+func renderValues(workflowConfig *Values) (string, error) {
 	tmpl, err := template.New("values").Parse(valuesTemplate)
 	if err != nil {
 		return "", err
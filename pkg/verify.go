@@ -0,0 +1,251 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	"k8s.io/client-go/1.5/pkg/api"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+const (
+	// SecretHashesConfigMap holds the data hashes of the hook secrets taken during
+	// the migration, for `verify` to compare against after the upgrade.
+	SecretHashesConfigMap = "workflow-migration-secret-hashes"
+	secretHashesKey       = "hashes"
+)
+
+type manifestObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+}
+
+// SecretHashes returns a hash of the data of each of the secrets that exists.
+func SecretHashes(kubeClient kubernetes.Interface, namespace string, secrets []string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	for _, name := range secrets {
+		secret, err := kubeClient.Core().Secrets(namespace).Get(name)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		hashes[name] = hashData(secret.Data)
+	}
+	return hashes, nil
+}
+
+func hashData(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%x\n", key, data[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// SaveSecretHashes stores the hashes in the SecretHashesConfigMap, replacing any
+// hashes recorded by an earlier run.
+func SaveSecretHashes(kubeClient kubernetes.Interface, namespace string, hashes map[string]string) error {
+	b, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	cfg := &v1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{
+			Name:   SecretHashesConfigMap,
+			Labels: map[string]string{"heritage": "workflow-migration"},
+		},
+		Data: map[string]string{secretHashesKey: string(b)},
+	}
+	if _, err := kubeClient.Core().ConfigMaps(namespace).Create(cfg); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+		_, err = kubeClient.Core().ConfigMaps(namespace).Update(cfg)
+		return err
+	}
+	return nil
+}
+
+// LoadSecretHashes returns the hashes recorded by SaveSecretHashes.
+func LoadSecretHashes(kubeClient kubernetes.Interface, namespace string) (map[string]string, error) {
+	cfg, err := kubeClient.Core().ConfigMaps(namespace).Get(SecretHashesConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	if err := json.Unmarshal([]byte(cfg.Data[secretHashesKey]), &hashes); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// ManifestObjects returns a reference to every object in a release manifest.
+// Objects without a namespace are placed in namespace.
+func ManifestObjects(manifest, namespace string) ([]ObjectRef, error) {
+	var objs []ObjectRef
+	for _, doc := range docSeparator.Split(manifest, -1) {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		obj := manifestObject{}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, err
+		}
+		if obj.Kind == "" {
+			continue
+		}
+		ns := obj.Metadata.Namespace
+		if ns == "" {
+			ns = namespace
+		}
+		objs = append(objs, ObjectRef{Kind: obj.Kind, Namespace: ns, Name: obj.Metadata.Name})
+	}
+	return objs, nil
+}
+
+// notCheckedError is returned by objectHealth for kinds it can't look up.
+type notCheckedError struct {
+	kind string
+}
+
+func (e notCheckedError) Error() string {
+	return fmt.Sprintf("%s objects are not checked", e.kind)
+}
+
+// Verify checks an upgraded release and returns everything that is wrong with it:
+// objects of the manifest that are missing or not ready, hook secrets whose data
+// changed since the migration, and a controller that doesn't answer its health
+// endpoint. No problems means the upgrade went through. The objects of kinds that
+// can't be looked up are returned as not checked rather than counted as healthy.
+func Verify(kubeClient kubernetes.Interface, rls *rspb.Release, controllerURL string) ([]string, []ObjectRef, error) {
+	var problems []string
+	var unchecked []ObjectRef
+	objs, err := ManifestObjects(rls.Manifest, rls.Namespace)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+	pods := make(map[string][]v1.Pod)
+	for _, obj := range objs {
+		if _, ok := pods[obj.Namespace]; !ok {
+			list, err := kubeClient.Core().Pods(obj.Namespace).List(api.ListOptions{})
+			if err != nil {
+				return nil, nil, err
+			}
+			pods[obj.Namespace] = list.Items
+		}
+		problem, err := objectHealth(kubeClient, obj, pods[obj.Namespace])
+		if _, ok := err.(notCheckedError); ok {
+			unchecked = append(unchecked, obj)
+			continue
+		}
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				problems = append(problems, fmt.Sprintf("%s: missing", obj))
+				continue
+			}
+			return nil, nil, err
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	hashes, err := LoadSecretHashes(kubeClient, rls.Namespace)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, nil, err
+	}
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("configmap %s/%s: missing, hook secrets can't be checked", rls.Namespace, SecretHashesConfigMap))
+	}
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	current, err := SecretHashes(kubeClient, rls.Namespace, names)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if hash, ok := current[name]; !ok {
+			problems = append(problems, fmt.Sprintf("secret %s: missing", name))
+		} else if hash != hashes[name] {
+			problems = append(problems, fmt.Sprintf("secret %s: data changed since the migration", name))
+		}
+	}
+
+	if controllerURL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(controllerURL)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("controller %s: %v", controllerURL, err))
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				problems = append(problems, fmt.Sprintf("controller %s: status %d", controllerURL, resp.StatusCode))
+			}
+		}
+	}
+	return problems, unchecked, nil
+}
+
+// objectHealth fetches the object and describes why it isn't ready, or returns ""
+// if it is. Kinds without a notion of readiness only need to exist. Kinds the
+// workflow charts don't use fail with a notCheckedError.
+func objectHealth(kubeClient kubernetes.Interface, obj ObjectRef, pods []v1.Pod) (string, error) {
+	var err error
+	switch obj.Kind {
+	case "Deployment":
+		deployment := &v1beta1.Deployment{}
+		err = getObject(kubeClient, obj.Kind, obj.Namespace, obj.Name, deployment)
+		if err == nil {
+			return deploymentHealth(deployment), nil
+		}
+	case "DaemonSet":
+		daemonset := &v1beta1.DaemonSet{}
+		err = getObject(kubeClient, obj.Kind, obj.Namespace, obj.Name, daemonset)
+		if err == nil {
+			return daemonSetHealth(daemonset, pods), nil
+		}
+	case "ReplicationController":
+		var rc *v1.ReplicationController
+		rc, err = kubeClient.Core().ReplicationControllers(obj.Namespace).Get(obj.Name)
+		if err == nil {
+			return replicationControllerHealth(rc, pods), nil
+		}
+	case "Service":
+		_, err = kubeClient.Core().Services(obj.Namespace).Get(obj.Name)
+	case "Secret":
+		_, err = kubeClient.Core().Secrets(obj.Namespace).Get(obj.Name)
+	case "ConfigMap":
+		_, err = kubeClient.Core().ConfigMaps(obj.Namespace).Get(obj.Name)
+	case "ServiceAccount":
+		_, err = kubeClient.Core().ServiceAccounts(obj.Namespace).Get(obj.Name)
+	case "PersistentVolumeClaim":
+		_, err = kubeClient.Core().PersistentVolumeClaims(obj.Namespace).Get(obj.Name)
+	default:
+		err = notCheckedError{kind: obj.Kind}
+	}
+	return "", err
+}
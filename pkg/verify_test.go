@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+)
+
+func TestVerify(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.discover("extensions/v1beta1", "Deployment", "DaemonSet")
+	one := int32(1)
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-router"},
+		Spec:       v1beta1.DeploymentSpec{Replicas: &one},
+		Status:     v1beta1.DeploymentStatus{AvailableReplicas: 1, UpdatedReplicas: 1},
+	})
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "deis-controller"},
+		Spec:       v1beta1.DeploymentSpec{Replicas: &one},
+	})
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "database-creds"}, Data: map[string][]byte{"user": []byte("deis")}})
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "builder-key-auth"}, Data: map[string][]byte{"key": []byte("old")}})
+	hashes, err := SecretHashes(clientset, "deis", []string{"database-creds", "builder-key-auth"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSecretHashes(clientset, "deis", hashes); err != nil {
+		t.Fatal(err)
+	}
+	s.add(t, "/api/v1/namespaces/deis/secrets", &v1.Secret{ObjectMeta: v1.ObjectMeta{Name: "builder-key-auth"}, Data: map[string][]byte{"key": []byte("regenerated")}})
+
+	controller := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer controller.Close()
+
+	rls := testRelease(2)
+	rls.Manifest = `---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-router
+---
+apiVersion: extensions/v1beta1
+kind: Deployment
+metadata:
+  name: deis-controller
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: deis-router
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: deis-router
+`
+	problems, unchecked, err := Verify(clientset, rls, controller.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"deployment deis-controller: 0/1 available, 0/1 updated",
+		"Service deis/deis-router: missing",
+		"secret builder-key-auth: data changed since the migration",
+		"controller " + controller.URL + ": status 503",
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("got problems %q, want %q", problems, want)
+	}
+	if want := []ObjectRef{{"Ingress", "deis", "deis-router"}}; !reflect.DeepEqual(unchecked, want) {
+		t.Errorf("got unchecked %v, want %v", unchecked, want)
+	}
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/client-go/1.5/kubernetes"
+	apierrors "k8s.io/client-go/1.5/pkg/api/errors"
+	rspb "k8s.io/helm/pkg/proto/hapi/release"
+)
+
+// WaitForRevision waits up to timeout for revisions to list a deployed revision
+// newer than version, and returns it, or 0 if none showed up in time. A newer
+// revision that failed or is still pending doesn't count, as it didn't replace the
+// deleted deployments. Failing to list the revisions is retried until the timeout.
+func WaitForRevision(revisions func() ([]Revision, error), version int32, timeout, interval time.Duration) (int32, error) {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for {
+		revs, err := revisions()
+		if err == nil {
+			for _, rev := range revs {
+				if rev.Version > version && strings.EqualFold(rev.Status, rspb.Status_DEPLOYED.String()) {
+					return rev.Version, nil
+				}
+			}
+		}
+		lastErr = err
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		time.Sleep(interval)
+	}
+	if lastErr != nil {
+		return 0, fmt.Errorf("listing revisions: %v", lastErr)
+	}
+	return 0, nil
+}
+
+// RestoreDeployments creates the deployments from their backups, taken before the
+// migration deleted them, and returns the names of those it created. Deployments
+// that exist again are left as they are.
+func RestoreDeployments(kubeClient kubernetes.Interface, namespace string, backups map[string][]byte) ([]string, error) {
+	r, err := ResolveResource(kubeClient, "Deployment")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(backups))
+	for name := range backups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var restored []string
+	for _, name := range names {
+		obj := Object{}
+		if err := yaml.Unmarshal(backups[name], &obj); err != nil {
+			return restored, fmt.Errorf("deployment %s: %v", name, err)
+		}
+		// the backup was read in the version the server serves, so it is created
+		// in that version too, without what the server added to it
+		obj["apiVersion"] = r.APIVersion()
+		obj["kind"] = "Deployment"
+		Normalize(obj)
+		if err := CreateObject(kubeClient, r, namespace, obj); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+			return restored, fmt.Errorf("deployment %s: %v", name, err)
+		}
+		restored = append(restored, name)
+	}
+	return restored, nil
+}
+
+// CleanupCommands returns the commands that delete the restored deployments again.
+// They aren't part of the release, so `helm upgrade` fails on them until they are
+// gone. Like the migration, the commands orphan the replica sets, so the pods keep
+// running until the upgrade replaces them.
+func CleanupCommands(namespace string, restored []string) []string {
+	if len(restored) == 0 {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("kubectl --namespace=%s delete deployment %s --cascade=false", namespace, strings.Join(restored, " ")),
+	}
+}
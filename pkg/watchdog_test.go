@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/1.5/pkg/api/v1"
+	"k8s.io/client-go/1.5/pkg/apis/extensions/v1beta1"
+)
+
+func TestWaitForRevision(t *testing.T) {
+	calls := 0
+	revisions := func() ([]Revision, error) {
+		calls++
+		switch {
+		case calls == 1:
+			return nil, errors.New("connection refused")
+		case calls < 4:
+			return []Revision{{Key: "deis-workflow.v1", Version: 1, Status: "DEPLOYED"}}, nil
+		case calls < 6:
+			// a failed upgrade leaves the deleted deployments missing
+			return []Revision{{Key: "deis-workflow.v1", Version: 1, Status: "DEPLOYED"}, {Key: "deis-workflow.v2", Version: 2, Status: "FAILED"}}, nil
+		}
+		return []Revision{{Key: "deis-workflow.v1", Version: 1, Status: "SUPERSEDED"}, {Key: "deis-workflow.v2", Version: 2, Status: "FAILED"}, {Key: "deis-workflow.v3", Version: 3, Status: "DEPLOYED"}}, nil
+	}
+	version, err := WaitForRevision(revisions, 1, time.Second, time.Millisecond)
+	if err != nil || version != 3 {
+		t.Errorf("got revision %d, %v, want 3", version, err)
+	}
+	if calls != 6 {
+		t.Errorf("listed the revisions %d times, want 6", calls)
+	}
+
+	version, err = WaitForRevision(func() ([]Revision, error) {
+		return []Revision{{Key: "deis-workflow.v1", Version: 1, Status: "deployed"}, {Key: "deis-workflow.v2", Version: 2, Status: "pending-upgrade"}}, nil
+	}, 1, 5*time.Millisecond, time.Millisecond)
+	if err != nil || version != 0 {
+		t.Errorf("got revision %d, %v, want 0 while the upgrade is pending", version, err)
+	}
+
+	version, err = WaitForRevision(func() ([]Revision, error) {
+		return []Revision{{Key: "deis-workflow.v1", Version: 1, Status: "DEPLOYED"}}, nil
+	}, 1, 5*time.Millisecond, time.Millisecond)
+	if err != nil || version != 0 {
+		t.Errorf("got revision %d, %v, want 0 without an upgrade", version, err)
+	}
+
+	_, err = WaitForRevision(func() ([]Revision, error) {
+		return nil, errors.New("connection refused")
+	}, 1, 5*time.Millisecond, time.Millisecond)
+	if err == nil {
+		t.Error("expected the listing error once the timeout passed")
+	}
+}
+
+func TestRestoreDeployments(t *testing.T) {
+	s, clientset := newTestServer(t)
+	defer s.Close()
+	s.discover("extensions/v1beta1", "Deployment")
+	s.add(t, "/apis/extensions/v1beta1/namespaces/deis/deployments", &v1beta1.Deployment{ObjectMeta: v1.ObjectMeta{Name: "deis-controller"}})
+
+	backups := map[string][]byte{
+		"deis-router":     []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: deis-router\n  resourceVersion: \"42\"\n  uid: 0f1c\nspec:\n  replicas: 2\nstatus:\n  replicas: 2\n"),
+		"deis-controller": []byte("kind: Deployment\nmetadata:\n  name: deis-controller\n"),
+	}
+	restored, err := RestoreDeployments(clientset, "deis", backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"deis-router"}; !reflect.DeepEqual(restored, want) {
+		t.Errorf("restored %v, want %v", restored, want)
+	}
+	router := s.get("/apis/extensions/v1beta1/namespaces/deis/deployments/deis-router")
+	if router == nil {
+		t.Fatal("deis-router wasn't created")
+	}
+	if router["apiVersion"] != "extensions/v1beta1" || router["status"] != nil || mapField(router, "metadata")["uid"] != nil {
+		t.Errorf("restored deployment wasn't normalized to the served version: %v", router)
+	}
+
+	backups["deis-registry"] = []byte("kind: Deployment\nmetadata:\n  name: deis-registry\n")
+	backups["deis-workflow-manager"] = []byte("metadata: [")
+	restored, err = RestoreDeployments(clientset, "deis", backups)
+	if err == nil {
+		t.Error("expected an error for an invalid backup")
+	}
+	// the caller reports what was restored before the failure
+	if want := []string{"deis-registry"}; !reflect.DeepEqual(restored, want) {
+		t.Errorf("restored %v before the failure, want %v", restored, want)
+	}
+}